@@ -1,213 +1,242 @@
 package cloud
 
-import "crypto/sha1"
-import "marvin/json/jsondata"
-import "fmt"
-
-/*
-type Verb uint8
-
-const (
-    Invalid Verb = iota
-    Register
-    SignIn
-    CheckUpdates
-    GetResourceURIs
-    Sync
-    SyncMetrics
-    BegCoins
-    OfferCoins
-    RejectBegCoins
-    GetLeaderBoard
-    VerifyOnlineStatus
-    SendTextMessage
-    ReceiveTextMessages
-        
+import (
+    "marvin/json/jsondata"
+    "marvin/store/datastore"
+    "marvin/store/datatypes"
+    "regexp"
 )
-*/
 
-type Error uint8
-const (
-    InvalidVerb Error = 2
-    MissingVerb Error = 4
-)
-
-type Response struct {
-}
-
-type RequestHandler func (* jsondata.JSONMap) *Response
-
-var reqHandlers map[string]RequestHandler = nil
-
-func InitRequestHandlers() {
-    reqHandlers = make(map[string]RequestHandler, 32)
-    
-    reqHandlers["register"] = ValidateRegisterRequest, true
-    reqHandlers["signin"] = signin, true
-    
-    reqHandlers["checkUpdates"] = checkUpdates, true
-    reqHandlers["getResourceURIs"] = getResourceURIs, true
-    
-    reqHandlers["receiveTextMessage"] = receiveTextMessages, true
-}
-
-func ValidateRequest(req *jsondata.JSONMap) *Response {
-    err := MissingVerb
-    
-    if cmd, res := req.GetString("verb"); res {
-        err = InvalidVerb
-        if handler := reqHandlers[cmd]; handler != nil {
-            return handler(req)
-        }
-    }
-    panic(err)
-}
-
-
-// register: (in) json
-//    { "name": "dprasad", "password": "coolVector", 
-//      "deviceId":"123456...", "osVersion":"2.2" }
-// returns: (out) json 
-//    (1) sha-1 key which is the unique id for this person on this device
-//    (2) returns additional JSON as getResourceURIs
-
-func ValidateRegisterRequest(req *jsondata.JSONMap) *Response {
-    name, r1      := req.GetString("name")
-    password, r2  := req.GetString("password")
-    device, r3    := req.GetString("deviceId")
-
-    if (r1 && r2 && r3) {
-        osVer, _ := req.GetString("osVersion")
-        hasher := sha1.New()
-        hasher.Write([]byte(name + password + device))
-        fmt.Printf("osVer: %v, hash size: %v, hash sum: %v\n", 
-                    osVer, hasher.Size(), hasher.Sum())
-        return nil
-    }
-    
-    panic("Ill-formed JSON for register request")
-}
-
-func signin(req *jsondata.JSONMap) *Response {
-    return nil
-}
-
-func getUID(req *jsondata.JSONMap) string {
+func getUID(req *jsondata.JSONMap) (string, bool) {
     if uid, r := req.GetString("uid"); r {
-        return uid
+        return uid, true
     }
-    panic("Fatal Error: missing UID in the request")
+    return req.GetString("hash")
 }
 
-// screen sizes
-const (
-    InvalidScreen int = iota
-    Small
-    Normal
-    Large
-    XtraLarge
-)
 func screenSize(s string) int {
     switch s {
-    case "small"  : return Small
-    case "normal" : return Normal
-    case "large"  : return Large
-    case "xlarge" : return XtraLarge
+    case "small"  : return datatypes.Small
+    case "normal" : return datatypes.Normal
+    case "large"  : return datatypes.Large
+    case "xlarge" : return datatypes.XtraLarge
     }
-    return InvalidScreen
+    return datatypes.InvalidScreen
 }
 
-const (
-    InvalidDensity int = iota
-    LDPI 
-    MDPI 
-    HDPI 
-    XDPI
-)
-
 func screenDensity(d string) int {
     switch d {
-    case "ldpi" : return LDPI
-    case "mdpi" : return MDPI
-    case "hdpi" : return HDPI
-    case "xdpi" : return XDPI
+    case "ldpi" : return datatypes.LDPI
+    case "mdpi" : return datatypes.MDPI
+    case "hdpi" : return datatypes.HDPI
+    case "xdpi" : return datatypes.XDPI
     }
-    return InvalidDensity
+    return datatypes.InvalidDensity
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+func validVersion(v string) bool {
+    return versionPattern.MatchString(v)
 }
 
 type CheckUpdateRequestParams struct {
     uid string
+    game, os string
     verApp, verRes string
     portraitX, portraitY int
     density, screenSize int
 }
 
-func parseUpdateParams(req* jsondata.JSONMap) *CheckUpdateRequestParams {
-    uid := getUID(req)
-    verApp, r1 := req.GetString("verApp")
-    verRes, r2 := req.GetString("verRes")
-    if (!r1 || !r2) { return nil }
-    
-    portraitX := 0
-    portraitY := 0
-    density := 0
-    size := InvalidScreen
-    
-    portraitX, _ = req.GetUInt("portraitX")
-    portraitY, _ = req.GetUInt("portraitY")
-    if (portraitX == 0 || portraitY == 0) {
-        return nil
+func parseUpdateParams(req* jsondata.JSONMap) (*CheckUpdateRequestParams, bool) {
+    uid, _ := getUID(req)
+    game, r1 := req.GetString("game")
+    os, r2 := req.GetString("os")
+    verApp, r3 := req.GetString("verApp")
+    verRes, r4 := req.GetString("verRes")
+    if (!r1 || !r2 || !r3 || !r4 || len(game) == 0 || !validVersion(verApp) || !validVersion(verRes)) {
+        return nil, false
     }
-    
+
+    portraitX, _ := req.GetUInt("portraitX")
+    portraitY, _ := req.GetUInt("portraitY")
+
     d, _ := req.GetString("density")
-    density = screenDensity(d)
+    density := screenDensity(d)
     d, _ = req.GetString("screenSize")
-    size = screenSize(d)
-    
-    p := CheckUpdateRequestParams{uid, verApp, verRes, 
-                                  portraitX, portraitY, 
+    size := screenSize(d)
+
+    p := CheckUpdateRequestParams{uid, game, os, verApp, verRes,
+                                  portraitX, portraitY,
                                   density, size}
-    return &p
-    
+    return &p, true
 }
 
-func checkUpdates(req* jsondata.JSONMap) (r *Response) {
-    r = nil
-    if p:= parseUpdateParams(req); p != nil {
-        r = doCheckUpdates(p)
+//
+// { "verb": "checkUpdates", "hash": <optional user-id>, "game": <game>, "os": <os>,
+//   "verApp": <dotted version>, "verRes": <dotted version>, ... }
+//
+func validateCheckUpdates(req *jsondata.JSONMap) Request {
+    p, ok := parseUpdateParams(req)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in checkUpdates request\"}"
+        return &BadRequest{jsonRes}
     }
-    
-    return r
+    return datastore.NewCheckUpdates(p.game, p.os, p.verApp, p.verRes)
 }
 
-func doCheckUpdates(p *CheckUpdateRequestParams) (r *Response) {
-    r = nil
-    fmt.Printf("%v, %v, %v, %d, %d, %d, %d\n", p.uid, p.verApp, p.verRes, 
-                                   p.portraitX, p.portraitY,
-                                   p.density, p.screenSize)
-    
-    return r
+//
+// { "verb": "setReleaseManifest", "adminKey": <key>, "game": <game>, "os": <os, "" for any>,
+//   "minApp": <version>, "latestApp": <version>, "latestRes": <version>, "appUrl": <optional url> }
+//
+func validateSetReleaseManifest(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    game, r1 := req.GetString("game")
+    os, _ := req.GetString("os")
+    minApp, r2 := req.GetString("minApp")
+    latestApp, r3 := req.GetString("latestApp")
+    latestRes, r4 := req.GetString("latestRes")
+    appURL, _ := req.GetString("appUrl")
+
+    if !r1 || !r2 || !r3 || !r4 || len(game) == 0 || !validVersion(minApp) || !validVersion(latestApp) ||
+       !validVersion(latestRes) || datastore.CompareVersions(minApp, latestApp) > 0 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in setReleaseManifest request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewSetReleaseManifest(game, os, minApp, latestApp, latestRes, appURL)
+}
+
+//
+// { "verb": "getResourceURIs", "hash": <optional user-id>, "game": <game>, "os": <os>,
+//   "verApp": <dotted version>, "verRes": <dotted version>, "density": <density>, "screenSize": <size>, ... }
+//
+func validateGetResourceURIs(req *jsondata.JSONMap) Request {
+    p, ok := parseUpdateParams(req)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getResourceURIs request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewGetResourceURIs(p.game, p.os, p.density, p.screenSize)
 }
 
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]+$`)
 
-func getResourceURIs(req* jsondata.JSONMap) (r *Response) {
-    r = nil
-    if p:= parseUpdateParams(req); p != nil {
-        r = doGetResourceURIs(p)
+//
+// { "verb": "registerResourceBundle", "adminKey": <key>, "game": <game>, "name": <bundle>, "version": <version>,
+//   "os": <optional os>, "density": <optional density>, "screenSize": <optional size>,
+//   "url": <url>, "size": <bytes>, "checksum": <sha1> }
+//
+func validateRegisterResourceBundle(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
     }
+    game, r1 := req.GetString("game")
+    name, r2 := req.GetString("name")
+    version, r3 := req.GetString("version")
+    url, r4 := req.GetString("url")
+    size, r5 := req.GetUInt("size")
+    checksum, r6 := req.GetString("checksum")
+    os, _ := req.GetString("os")
+    d, _ := req.GetString("density")
+    s, _ := req.GetString("screenSize")
+    density, screen := screenDensity(d), screenSize(s)
     
-    return r
+    if !r1 || !r2 || !r3 || !r4 || !r5 || !r6 || len(game) == 0 || len(name) == 0 || !validVersion(version) ||
+       !httpURLPattern.MatchString(url) || !checksumPattern.MatchString(checksum) || len(checksum) != 40 ||
+       (d != "" && density == datatypes.InvalidDensity) || (s != "" && screen == datatypes.InvalidScreen) {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in registerResourceBundle request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewRegisterResourceBundle(datatypes.ResourceBundle{game, name, version, os, density, screen,
+                                                                        url, int64(size), checksum})
 }
 
-func doGetResourceURIs(p *CheckUpdateRequestParams) (r *Response) {
-    r = nil
-    fmt.Printf("%v, %v, %v, %d, %d, %d, %d\n", p.uid, p.verApp, p.verRes, 
-                                   p.portraitX, p.portraitY,
-                                   p.density, p.screenSize)
-    return r
+//
+// { "verb": "getConfig", "hash": <optional user-id>, "game": <game>,
+//   "os": <os>, "osVersion": <version>, "verApp": <version>, "density": <density>, "screenSize": <size>,
+//   "country": <optional code> }
+//
+func validateGetConfig(req *jsondata.JSONMap) Request {
+    hash, _ := req.GetString("hash")
+    game, r1 := req.GetString("game")
+    os, _ := req.GetString("os")
+    osVer, _ := req.GetString("osVersion")
+    verApp, _ := req.GetString("verApp")
+    d, _ := req.GetString("density")
+    s, _ := req.GetString("screenSize")
+    country, _ := req.GetString("country")
+    
+    if !r1 || len(game) == 0 || (verApp != "" && !validVersion(verApp)) || (country != "" && !countryPattern.MatchString(country)) {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getConfig request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewGetConfig(hash, game, datatypes.ConfigTarget{"", os, osVer, verApp,
+                                                                     screenSize(s), screenDensity(d), country})
 }
 
-func receiveTextMessages(req *jsondata.JSONMap) *Response {
-    return nil
+//
+// { "verb": "setConfig", "adminKey": <key>, "game": <game>, "key": <key>, "value": <value>,
+//   "id": <override, "" for the base value>, "priority": <n>, "os": <os>, "minOsVersion": <version>,
+//   "maxOsVersion": <version>, "minApp": <version>, "maxApp": <version>, "density": <density>,
+//   "screenSize": <size>, "country": <code>, "rollout": <percent, 100 when missing> }
+//
+func validateSetConfig(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    game, r1 := req.GetString("game")
+    key, r2 := req.GetString("key")
+    value, r3 := req.GetString("value")
+    id, _ := req.GetString("id")
+    priority, _ := req.GetUInt("priority")
+    os, _ := req.GetString("os")
+    minOSVer, _ := req.GetString("minOsVersion")
+    maxOSVer, _ := req.GetString("maxOsVersion")
+    minApp, _ := req.GetString("minApp")
+    maxApp, _ := req.GetString("maxApp")
+    d, _ := req.GetString("density")
+    s, _ := req.GetString("screenSize")
+    country, _ := req.GetString("country")
+    rollout, r4 := req.GetUInt("rollout")
+    if !r4 {
+        rollout = 100
+    }
+    density, screen := screenDensity(d), screenSize(s)
+    
+    conditional := os != "" || minOSVer != "" || maxOSVer != "" || minApp != "" || maxApp != "" ||
+                   d != "" || s != "" || country != "" || rollout < 100
+    versions := []string{minOSVer, maxOSVer, minApp, maxApp}
+    validVersions := true
+    for _, v := range versions {
+        validVersions = validVersions && (v == "" || validVersion(v))
+    }
+    if !r1 || !r2 || !r3 || len(game) == 0 || len(key) == 0 || !validVersions || rollout > 100 ||
+       (d != "" && density == datatypes.InvalidDensity) || (s != "" && screen == datatypes.InvalidScreen) ||
+       (country != "" && !countryPattern.MatchString(country)) || (id == "" && (conditional || priority != 0)) ||
+       (id != "" && priority == 0) {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in setConfig request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewSetConfig(datatypes.ConfigEntry{game, key, value, id, priority, os, minOSVer, maxOSVer,
+                                                        minApp, maxApp, screen, density, country, rollout})
 }
 
+//
+// { "verb": "removeConfig", "adminKey": <key>, "game": <game>, "key": <key>, "id": <override, "" for the base value> }
+//
+func validateRemoveConfig(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    game, r1 := req.GetString("game")
+    key, r2 := req.GetString("key")
+    id, _ := req.GetString("id")
+    
+    if !r1 || !r2 || len(game) == 0 || len(key) == 0 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in removeConfig request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewRemoveConfig(game, key, id)
+}
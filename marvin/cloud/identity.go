@@ -0,0 +1,134 @@
+package cloud
+
+import (
+    "fmt"
+    "http"
+    "json"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// An IdentityProvider verifies that a client owns an identity on an external
+// network, from an access token the client obtained from that network.
+type IdentityProvider interface {
+    // Verify returns the id, on the provider's network, of the owner of the token
+    Verify(token string) (id string, err os.Error)
+}
+
+var identityProviders = struct {
+    sync.RWMutex
+    byProfile map[string]IdentityProvider
+}{byProfile: make(map[string]IdentityProvider)}
+
+// RegisterIdentityProvider installs the provider verifying the identities of
+// a profile ("fb", "tw"). Profiles without a provider cannot be claimed, but
+// for our own ("99"), which is password based.
+func RegisterIdentityProvider(profile string, provider IdentityProvider) {
+    identityProviders.Lock()
+    defer identityProviders.Unlock()
+    identityProviders.byProfile[profile] = provider, provider != nil
+}
+
+// verifyIdentity checks the token against the profile's provider, and returns
+// the verified profile id. A non empty profileId must match it. The id of our
+// own profile is the account's name, whatever the client claims.
+func verifyIdentity(profile string, name string, profileId string, token string) (string, bool) {
+    if profile == "99" {
+        return name, true
+    }
+
+    identityProviders.RLock()
+    provider := identityProviders.byProfile[profile]
+    identityProviders.RUnlock()
+    if provider == nil || token == "" {
+        return "", false
+    }
+
+    id, err := provider.Verify(token)
+    if err != nil {
+        fmt.Printf("Identity verification failed (%s): %v\n", profile, err)
+        return "", false
+    }
+    if id == "" || (profileId != "" && profileId != id) {
+        return "", false
+    }
+    return id, true
+}
+
+///////
+// HTTPTokenProvider asks the network who owns the token: URL holds a %s for
+// the escaped token, and the JSON answer holds the owner's id in IdField. The
+// network has Timeout seconds to answer, DEFAULT_VERIFY_TIMEOUT when 0.
+//
+//    &HTTPTokenProvider{URL: "https://graph.facebook.com/me?fields=id&access_token=%s", IdField: "id"}
+type HTTPTokenProvider struct {
+    URL     string
+    IdField string
+    Timeout int64
+}
+
+const DEFAULT_VERIFY_TIMEOUT = 5
+
+func (p *HTTPTokenProvider) Verify(token string) (string, os.Error) {
+    timeout := p.Timeout
+    if timeout <= 0 {
+        timeout = DEFAULT_VERIFY_TIMEOUT
+    }
+
+    type result struct {
+        id  string
+        err os.Error
+    }
+    // the request itself is abandoned, not cancelled, on timeout
+    done := make(chan result, 1)
+    go func() {
+        id, err := p.verify(token)
+        done <- result{id, err}
+    }()
+    select {
+    case r := <-done:
+        return r.id, r.err
+    case <-time.After(timeout * 1e9):
+    }
+    return "", os.NewError("no answer in time")
+}
+
+func (p *HTTPTokenProvider) verify(token string) (string, os.Error) {
+    res, err := http.Get(fmt.Sprintf(p.URL, http.URLEscape(token)))
+    if err != nil {
+        return "", err
+    }
+    defer res.Body.Close()
+
+    if res.StatusCode != http.StatusOK {
+        return "", os.NewError("token rejected: " + res.Status)
+    }
+
+    var answer map[string]interface{}
+    if err = json.NewDecoder(res.Body).Decode(&answer); err != nil {
+        return "", err
+    }
+    switch id := answer[p.IdField].(type) {
+    case string:
+        return id, nil
+    case float64:
+        return fmt.Sprintf("%.0f", id), nil
+    }
+    return "", os.NewError("no " + p.IdField + " in the answer")
+}
+
+///////
+// StubIdentityProvider trusts tokens of the form "stub:<id>", for tests and
+// local setups only.
+type StubIdentityProvider struct{}
+
+const stubTokenPrefix = "stub:"
+
+func (p *StubIdentityProvider) Verify(token string) (string, os.Error) {
+    if !strings.HasPrefix(token, stubTokenPrefix) {
+        return "", os.NewError("not a stub token")
+    }
+    return token[len(stubTokenPrefix):], nil
+}
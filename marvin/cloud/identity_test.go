@@ -0,0 +1,97 @@
+package cloud
+
+import (
+    "fmt"
+    "http"
+    "http/httptest"
+    "testing"
+    "time"
+)
+
+func TestStubIdentityProvider(t *testing.T) {
+    tests := []struct {
+        token string
+        id    string
+        ok    bool
+    }{
+        {"stub:1234", "1234", true},
+        {"stub:", "", true},
+        {"1234", "", false},
+        {"", "", false},
+    }
+    p := &StubIdentityProvider{}
+    for _, test := range tests {
+        id, err := p.Verify(test.token)
+        if id != test.id || (err == nil) != test.ok {
+            t.Errorf("Verify(%q) = %q, %v, want %q, %v", test.token, id, err, test.id, test.ok)
+        }
+    }
+}
+
+func TestVerifyIdentity(t *testing.T) {
+    RegisterIdentityProvider("fb", &StubIdentityProvider{})
+    defer RegisterIdentityProvider("fb", nil)
+
+    tests := []struct {
+        profile, name, profileId, token string
+        id                              string
+        ok                              bool
+    }{
+        // our own profile is the name, whatever the client claims
+        {"99", "player1", "", "", "player1", true},
+        {"99", "player1", "someone-else", "", "player1", true},
+        {"fb", "player1", "", "stub:1234", "1234", true},
+        {"fb", "player1", "1234", "stub:1234", "1234", true},
+        {"fb", "player1", "5678", "stub:1234", "", false},
+        {"fb", "player1", "1234", "", "", false},
+        {"fb", "player1", "1234", "forged", "", false},
+        {"fb", "player1", "", "stub:", "", false},
+        // no provider
+        {"tw", "player1", "1234", "stub:1234", "", false},
+    }
+    for _, test := range tests {
+        id, ok := verifyIdentity(test.profile, test.name, test.profileId, test.token)
+        if id != test.id || ok != test.ok {
+            t.Errorf("verifyIdentity(%q, %q, %q, %q) = %q, %v, want %q, %v", test.profile, test.name,
+                     test.profileId, test.token, id, ok, test.id, test.ok)
+        }
+    }
+}
+
+func TestHTTPTokenProvider(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.FormValue("token") {
+        case "numeric":
+            fmt.Fprint(w, `{"id": 1234}`)
+        case "string":
+            fmt.Fprint(w, `{"id": "1234"}`)
+        case "missing":
+            fmt.Fprint(w, `{"name": "player1"}`)
+        case "slow":
+            time.Sleep(3e9)
+            fmt.Fprint(w, `{"id": "1234"}`)
+        default:
+            w.WriteHeader(http.StatusUnauthorized)
+        }
+    }))
+    defer server.Close()
+
+    tests := []struct {
+        token string
+        id    string
+        ok    bool
+    }{
+        {"numeric", "1234", true},
+        {"string", "1234", true},
+        {"missing", "", false},
+        {"rejected", "", false},
+        {"slow", "", false},
+    }
+    p := &HTTPTokenProvider{URL: server.URL + "/?token=%s", IdField: "id", Timeout: 1}
+    for _, test := range tests {
+        id, err := p.Verify(test.token)
+        if id != test.id || (err == nil) != test.ok {
+            t.Errorf("Verify(%q) = %q, %v, want %q, %v", test.token, id, err, test.id, test.ok)
+        }
+    }
+}
@@ -1,12 +1,15 @@
 package cloud
 
 import (
+    "crypto/subtle"
     "http"
     "io"
     "marvin/store/datastore"
     "marvin/json/jsondata"
     "marvin/store/datatypes"
     "fmt"
+    "regexp"
+    "strings"
 )
 
 type Verb uint8
@@ -101,21 +104,24 @@ func NewHTTPResponseWriter(rw http.ResponseWriter) *HTTPResponseWriter {
     return &(HTTPResponseWriter{rw})
 }
 
+// most of our messages are under 1k; the largest are importFriends and
+// getOnlineStatus at their maximum list lengths
+const MaxRequestSize = 64 * 1024
+
 func (* HTTPRequestReader) Read(req *http.Request) jsondata.JSONString {
     body := req.Body
     defer body.Close()
     
     var json []byte
     
-    // all our messages are at most 1k in size
     jsonChunk := make([]byte, 1024)
     for {
         n, e := body.Read(jsonChunk)
-        if n > 8 {
+        if n > 0 {
             json = append(json, jsonChunk[:n]...)
         }
         
-        if (e != nil || len(json) >= 1024) {
+        if (e != nil || len(json) >= MaxRequestSize) {
             break
         }
     }
@@ -148,9 +154,13 @@ func InitRequestHandlers() {
     
     reqHandlers["setScore"] = validateSetScore, true
     reqHandlers["getScore"] = validateGetScore, true
+    reqHandlers["startRun"] = validateStartRun, true
+    reqHandlers["endRun"] = validateEndRun, true
     
     reqHandlers["setAchievement"] = validateSetAchievement, true
     reqHandlers["getAchievements"] = validateGetAchievements, true
+    reqHandlers["getAchievementCatalog"] = validateGetAchievementCatalog, true
+    reqHandlers["incrementAchievement"] = validateIncrementAchievement, true
         
     reqHandlers["requestCoins"] = validateRequestCoins, true
     reqHandlers["offerCoins"] = validateOfferCoins, true
@@ -162,16 +172,85 @@ func InitRequestHandlers() {
 
     reqHandlers["sendMessage"] = validateSendMessage, true
     reqHandlers["receiveMessage"] = validateReceiveMessage, true
+    reqHandlers["ackMessages"] = validateAckMessages, true
+    reqHandlers["blockUser"] = validateBlockUser, true
+    reqHandlers["unblockUser"] = validateUnblockUser, true
+    reqHandlers["getBlockedUsers"] = validateGetBlockedUsers, true
+    reqHandlers["reportMessage"] = validateReportMessage, true
+    reqHandlers["createConversation"] = validateCreateConversation, true
+    reqHandlers["listConversations"] = validateListConversations, true
+    reqHandlers["getConversation"] = validateGetConversation, true
+
+    reqHandlers["inviteFriend"] = validateFriendRequest, true
+    reqHandlers["acceptFriend"] = validateFriendRequest, true
+    reqHandlers["declineFriend"] = validateFriendRequest, true
+    reqHandlers["removeFriend"] = validateFriendRequest, true
+    reqHandlers["listFriends"] = validateListFriends, true
+    reqHandlers["importFriends"] = validateImportFriends, true
+
+    reqHandlers["heartbeat"] = validateHeartbeat, true
+    reqHandlers["getOnlineStatus"] = validateGetOnlineStatus, true
+
+    reqHandlers["getProfile"] = validateGetProfile, true
+    reqHandlers["updateProfile"] = validateUpdateProfile, true
+
+    reqHandlers["requestLinkCode"] = validateRequestLinkCode, true
+    reqHandlers["linkDevice"] = validateLinkDevice, true
+    reqHandlers["listDevices"] = validateListDevices, true
+    reqHandlers["unlinkDevice"] = validateUnlinkDevice, true
+
+    reqHandlers["registerGuest"] = validateRegisterGuest, true
+    reqHandlers["upgradeAccount"] = validateUpgradeAccount, true
+    reqHandlers["exportMyData"] = validateExportMyData, true
+
+    reqHandlers["setAccountStatus"] = validateSetAccountStatus, true
+    reqHandlers["acceptScore"] = validateAcceptScore, true
+    reqHandlers["rejectScore"] = validateRejectScore, true
+    reqHandlers["setScoreRule"] = validateSetScoreRule, true
+    reqHandlers["defineAchievement"] = validateDefineAchievement, true
+
+    reqHandlers["requestPasswordReset"] = validateRequestPasswordReset, true
+    reqHandlers["verifyResetCode"] = validateVerifyResetCode, true
+    reqHandlers["resetPassword"] = validateResetPassword, true
+
+    reqHandlers["checkUpdates"] = validateCheckUpdates, true
+    reqHandlers["setReleaseManifest"] = validateSetReleaseManifest, true
+    reqHandlers["getResourceURIs"] = validateGetResourceURIs, true
+    reqHandlers["registerResourceBundle"] = validateRegisterResourceBundle, true
+
+    reqHandlers["getConfig"] = validateGetConfig, true
+    reqHandlers["setConfig"] = validateSetConfig, true
+    reqHandlers["removeConfig"] = validateRemoveConfig, true
 }
 
 var mapVerbResource = map [string] string {
 	"register": "/marvin/registration/", "unregister": "/marvin/unregister/",
 	"setScore": "/marvin/scores/", "getScore": "/marvin/scores/",
+	"startRun": "/marvin/scores/", "endRun": "/marvin/scores/",
 	"setAchievement": "/marvin/achievements/", "getAchievements": "/marvin/achievements/",
+	"getAchievementCatalog": "/marvin/achievements/", "incrementAchievement": "/marvin/achievements/",
 	"requestCoins": "/marvin/coins/", "offerCoins": "/marvin/coins/", "syncCoinCounts": "/marvin/coins/", 
 	"getPendingCoinRequests": "/marvin/coins/", "getCoinCount": "/marvin/coins/",
 	"getLeaderBoard": "/marvin/leaderboard/",
 	"sendMessage": "/marvin/messages/", "receiveMessage": "/marvin/messages/",
+	"ackMessages": "/marvin/messages/", "reportMessage": "/marvin/messages/",
+	"blockUser": "/marvin/messages/", "unblockUser": "/marvin/messages/", "getBlockedUsers": "/marvin/messages/",
+	"createConversation": "/marvin/messages/", "listConversations": "/marvin/messages/", "getConversation": "/marvin/messages/",
+	"inviteFriend": "/marvin/friends/", "acceptFriend": "/marvin/friends/", "declineFriend": "/marvin/friends/",
+	"removeFriend": "/marvin/friends/", "listFriends": "/marvin/friends/", "importFriends": "/marvin/friends/",
+	"heartbeat": "/marvin/presence/", "getOnlineStatus": "/marvin/presence/",
+	"getProfile": "/marvin/profile/", "updateProfile": "/marvin/profile/",
+	"requestLinkCode": "/marvin/devices/", "linkDevice": "/marvin/devices/",
+	"listDevices": "/marvin/devices/", "unlinkDevice": "/marvin/devices/",
+	"registerGuest": "/marvin/registration/", "upgradeAccount": "/marvin/registration/",
+	"exportMyData": "/marvin/profile/",
+	"setAccountStatus": "/marvin/admin/", "acceptScore": "/marvin/admin/", "rejectScore": "/marvin/admin/",
+	"setScoreRule": "/marvin/admin/", "defineAchievement": "/marvin/admin/",
+	"requestPasswordReset": "/marvin/recovery/", "verifyResetCode": "/marvin/recovery/",
+	"resetPassword": "/marvin/recovery/",
+	"checkUpdates": "/marvin/updates/", "setReleaseManifest": "/marvin/admin/",
+	"getResourceURIs": "/marvin/updates/", "registerResourceBundle": "/marvin/admin/",
+	"getConfig": "/marvin/config/", "setConfig": "/marvin/admin/", "removeConfig": "/marvin/admin/",
 }
 
 func isVerbValidForResource(resource string, verb string) bool {
@@ -181,6 +260,97 @@ func isVerbValidForResource(resource string, verb string) bool {
     return false
 }
 
+///////
+// Presence. Every request of a registered user counts as a sign of life.
+
+// The field holding the caller's hash, for the verbs not using "hash". Verbs
+// mapped to "" are not issued by a registered user.
+var callerFields = map [string] string {
+	"register": "", "getCoinCount": "", "linkDevice": "", "registerGuest": "",
+	"setAccountStatus": "", "acceptScore": "", "rejectScore": "", "setScoreRule": "", "defineAchievement": "",
+	"requestPasswordReset": "", "verifyResetCode": "", "resetPassword": "",
+	"setReleaseManifest": "", "registerResourceBundle": "", "setConfig": "", "removeConfig": "",
+	"requestCoins": "requester", "offerCoins": "donor",
+	"sendMessage": "from", "receiveMessage": "receiver", "ackMessages": "receiver",
+}
+
+// The rate limited verbs, limited per caller
+var rateLimits = map [string] *datastore.RateLimiter {
+	"sendMessage": messageRate,
+}
+
+type touchingRequest struct {
+    Request
+    hash string
+}
+
+func (tr *touchingRequest) Perform() datatypes.Response {
+    response := tr.Request.Perform()
+    datastore.Touch(tr.hash)
+    return response
+}
+
+func dispatch(handler RequestHandler, verb string, jsonMap *jsondata.JSONMap) Request {
+    field, found := callerFields[verb]
+    if !found {
+        field = "hash"
+    }
+    // linked devices sign their requests with a credential of their own,
+    // standing for the account's hash
+    if credential, ok := jsonMap.GetString(field); ok && field != "" {
+        if hash, linked := datastore.AccountHash(credential); linked && hash != credential {
+            jsonMap.SetString(field, hash)
+        }
+    }
+    
+    request := handler(jsonMap)
+    if _, bad := request.(*BadRequest); bad {
+        return request
+    }
+    if hash, ok := jsonMap.GetString(field); ok && field != "" {
+        if admitted, reason := datastore.Admit(hash); !admitted {
+            return &BadRequest{"{\"result\": false, \"answer\": \"" + reason + "\"}"}
+        }
+        // unknown callers are turned away by the request itself
+        if limiter := rateLimits[verb]; limiter != nil {
+            if name, known := datastore.AccountName(hash); known && !limiter.Allow(name) {
+                return &BadRequest{"{\"result\": false, \"answer\": \"too many " + verb + " requests, try again later\"}"}
+            }
+        }
+        return &touchingRequest{request, hash}
+    }
+    return request
+}
+
+// ValidateMessage validates a request arriving over the WebSocket channel,
+// where verbs are not bound to their REST-resources.
+func ValidateMessage(json jsondata.JSONString) Request {
+    if jsonMap := jsondata.UnmarshalJSON(json); jsonMap != nil {
+        if cmd, res := jsonMap.GetString("verb"); res {
+            if handler := reqHandlers[cmd]; handler != nil {
+                return dispatch(handler, cmd, jsonMap)
+            }
+            return &BadRequest{"{\"result\": false, \"answer\": \"unknown verb in the request (" + cmd + ")\"}"}
+        }
+        return &BadRequest{"{\"result\": false, \"answer\": \"missing verb in the request\"}"}
+    }
+    return &BadRequest{"{\"result\": false, \"answer\": \"bad or unrecognized JSON\"}"}
+}
+
+// AuthenticateSocket checks the first message of a WebSocket connection,
+//    { "verb": "connect", "hash": <user-id> }
+// and returns the name of the connecting user.
+func AuthenticateSocket(json jsondata.JSONString) (name string, ok bool) {
+    if jsonMap := jsondata.UnmarshalJSON(json); jsonMap != nil {
+        verb, r1 := jsonMap.GetString("verb")
+        hash, r2 := jsonMap.GetString("hash")
+        if r1 && r2 && verb == "connect" && len(hash) >= 6 {
+            return datastore.Authenticate(hash)
+        }
+    }
+    return "", false
+}
+
 func validateRequest(httpReq *http.Request, jsonMap *jsondata.JSONMap) Request {
     var reason string = "missing verb in the request"
     
@@ -188,7 +358,7 @@ func validateRequest(httpReq *http.Request, jsonMap *jsondata.JSONMap) Request {
         reason = "Invalid or unknown REST-resource and verb combined in the request (" + httpReq.RawURL + " : " + cmd + ")"
         if handler := reqHandlers[cmd]; handler != nil {
             if isVerbValidForResource(httpReq.URL.Path, cmd) {
-                return handler(jsonMap)
+                return dispatch(handler, cmd, jsonMap)
             }
         }
     }
@@ -210,10 +380,50 @@ func validateSetScore(req *jsondata.JSONMap) Request {
     if (!r1 || !r2 || !r3 || score < 0 || len(hash) < 6 || len(game) < 6) {
         return &BadRequest{json}
     }
+    if !datastore.ValidScore(game, score) {
+        return &BadRequest{"{\"result\": false, \"answer\": \"score out of bounds for " + game + "\"}"}
+    }
     
     return datastore.NewSetScoreRequest(hash, game, score)
 }
 
+//
+// { "verb": "startRun", "hash": <user-id>, "game": <game name> }
+// { "result": true, "answer" : <run token> }
+//
+func validateStartRun(req *jsondata.JSONMap) Request {
+    hash, r1   := req.GetString("hash")
+    game, r2   := req.GetString("game")
+    
+    json := "{\"result\": false, \"answer\": \"missing or invalid arguments in startRun request\"}"
+    if (!r1 || !r2 || len(hash) < 6 || len(game) < 6) {
+        return &BadRequest{json}
+    }
+    
+    return datastore.NewStartRunRequest(hash, game)
+}
+
+//
+// { "verb": "endRun", "hash": <user-id>, "game": <game name>, "run": <run token>, "score": <unsigned integer> }
+// { "result": true, "answer" : "" }
+//
+func validateEndRun(req *jsondata.JSONMap) Request {
+    hash, r1   := req.GetString("hash")
+    score, r2  := req.GetUInt("score")
+    game, r3   := req.GetString("game")
+    run, r4    := req.GetString("run")
+    
+    json := "{\"result\": false, \"answer\": \"missing or invalid arguments in endRun request\"}"
+    if (!r1 || !r2 || !r3 || !r4 || score < 0 || len(hash) < 6 || len(game) < 6 || len(run) == 0) {
+        return &BadRequest{json}
+    }
+    if !datastore.ValidScore(game, score) {
+        return &BadRequest{"{\"result\": false, \"answer\": \"score out of bounds for " + game + "\"}"}
+    }
+    
+    return datastore.NewEndRunRequest(hash, game, run, score)
+}
+
 //
 // { "verb": "getScore", "hash": <user-id> , "game": <game-name>}
 // { "result": true, "answer" : <score-unsigned-int> }
@@ -233,25 +443,74 @@ func validateGetScore(req *jsondata.JSONMap) Request {
 
 //////
 
+//
+// { "verb": "getAchievements", "hash": <user-id>, "player": <name or profile id, optional>, "game": <game name, optional> }
+//
 func validateGetAchievements(req *jsondata.JSONMap) Request {
     hash, r1   := req.GetString("hash")
+    player, _  := req.GetString("player")
+    game, _    := req.GetString("game")
     
     json := "{\"result\": false, \"answer\": \"missing or invalid arguments in getAchievements request\"}"
     if (!r1 || len(hash) < 6) {
         return &BadRequest{json}
     }
-    return datastore.NewGetAchievementRequest(hash)
+    return datastore.NewGetAchievementRequest(hash, player, game)
 }
 
+//
+// { "verb": "setAchievement", "hash": <user-id>, "game": <game name>, "achievement": <achievement id> }
+//
 func validateSetAchievement(req *jsondata.JSONMap) Request {
     hash, r1   := req.GetString("hash")
-    achievement, r2 := req.GetUInt("achievement")
+    game, r2   := req.GetString("game")
     
     json := "{\"result\": false, \"answer\": \"missing or invalid arguments in setAchievement request\"}"
-    if (!r1 || !r2 || len(hash) < 6) {
+    if !r2 {
+        // { "verb": "setAchievement", "hash": <user-id>, "achievement": <unsigned integer> }, as sent by
+        // the clients predating the catalog
+        achievement, r3 := req.GetUInt("achievement")
+        if (!r1 || !r3 || len(hash) < 6) {
+            return &BadRequest{json}
+        }
+        return datastore.NewLegacySetAchievementRequest(hash, achievement)
+    }
+
+    achievement, r3 := req.GetString("achievement")
+    if (!r1 || !r3 || len(hash) < 6 || len(game) < 6 || len(achievement) == 0) {
+        return &BadRequest{json}
+    }
+    return datastore.NewSetAchievementRequest(hash, game, achievement)
+}
+
+//
+// { "verb": "incrementAchievement", "hash": <user-id>, "game": <game name>, "achievement": <achievement id>, "amount": <unsigned integer> }
+//
+func validateIncrementAchievement(req *jsondata.JSONMap) Request {
+    hash, r1   := req.GetString("hash")
+    game, r2   := req.GetString("game")
+    achievement, r3 := req.GetString("achievement")
+    amount, r4 := req.GetUInt("amount")
+    
+    json := "{\"result\": false, \"answer\": \"missing or invalid arguments in incrementAchievement request\"}"
+    if (!r1 || !r2 || !r3 || !r4 || amount <= 0 || len(hash) < 6 || len(game) < 6 || len(achievement) == 0) {
+        return &BadRequest{json}
+    }
+    return datastore.NewIncrementAchievementRequest(hash, game, achievement, amount)
+}
+
+//
+// { "verb": "getAchievementCatalog", "hash": <user-id>, "game": <game name> }
+//
+func validateGetAchievementCatalog(req *jsondata.JSONMap) Request {
+    hash, r1   := req.GetString("hash")
+    game, r2   := req.GetString("game")
+    
+    json := "{\"result\": false, \"answer\": \"missing or invalid arguments in getAchievementCatalog request\"}"
+    if (!r1 || !r2 || len(hash) < 6 || len(game) < 6) {
         return &BadRequest{json}
     }
-    return datastore.NewSetAchievementRequest(hash, achievement)
+    return datastore.NewGetAchievementCatalogRequest(hash, game)
 }
 
 //
@@ -303,6 +562,7 @@ func validateSyncCoinCounts(req *jsondata.JSONMap) Request {
 // register: (in) json
 //    { "name": "dprasad", "password": "coolVector", 
 //      "deviceId":"123456...", "osVersion":"2.2" }
+//    "fb" and "tw" profiles also carry the network's "accessToken"
 // returns: (out) json 
 //    (1) sha-1 key which is the unique id for this person on this device
 //    (2) returns additional JSON as getResourceURIs
@@ -322,6 +582,16 @@ func validateRegisterRequest(req *jsondata.JSONMap) Request {
     }
     
     displayName, _  := req.GetString("displayName")
+    if datastore.ReservedName(name) || datastore.ReservedName(displayName) {
+        return &BadRequest{"{\"result\": false, \"answer\": \"this name is reserved\"}"}
+    }
+    profileId, _ := req.GetString("profileId")
+    // external identities must be proven with the network's access token
+    token, _ := req.GetString("accessToken")
+    profileId, verified := verifyIdentity(profile, name, profileId, token)
+    if !verified {
+        return &BadRequest{"{\"result\": false, \"answer\": \"profile identity could not be verified\"}"}
+    }
     os, _ := req.GetString("os")
     osVer, _ := req.GetString("osVersion")
     density, _ := req.GetString("density")
@@ -333,7 +603,7 @@ func validateRegisterRequest(req *jsondata.JSONMap) Request {
     hasher.Write([]byte(name + password + device))
     hash := hasher.Sum()*/
     hash := name + "**" + device
-    return datastore.NewUserDevice(name, displayName, password, device, hash, profile, os, osVer, portraitX, portraitY, density, screen)
+    return datastore.NewUserDevice(name, displayName, password, device, hash, profile, profileId, os, osVer, portraitX, portraitY, density, screen)
 }
 
 // unregister: (in) json
@@ -382,44 +652,732 @@ func validateOfferCoins(req *jsondata.JSONMap) Request {
     return datastore.NewCoinsOffer(requester, donor, offer, countOnDevice)
 }
 
+//
+// { "verb": "getLeaderBoard", "hash": <user-id> }
+// { "verb": "getLeaderBoard", "hash": <user-id>, "mode": "aroundMe", "game": <game name>, "window": <unsigned integer> }
+//
+const (
+    DefaultLeaderBoardWindow = 10
+    MaxLeaderBoardWindow     = 50
+)
+
 func validateGetLeaderBoard(req *jsondata.JSONMap) Request {
     hash, r1 := req.GetString("hash")
+    mode, _ := req.GetString("mode")
     
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getLeaderBoard request\"}"
     if !r1 || len(hash) < 6 {
-        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getLeaderBoard request\"}"
         return &BadRequest{jsonRes}
     }
     
-    return datastore.NewLeaderBoardRequest(hash)
+    switch mode {
+    case "", "top":
+        return datastore.NewLeaderBoardRequest(hash)
+    case "aroundMe":
+        game, r2 := req.GetString("game")
+        window, r3 := req.GetUInt("window")
+        if !r3 {
+            window = DefaultLeaderBoardWindow
+        }
+        if !r2 || len(game) < 6 || window <= 0 || window > MaxLeaderBoardWindow {
+            return &BadRequest{jsonRes}
+        }
+        return datastore.NewAroundMeLeaderBoardRequest(hash, game, window)
+    }
+    
+    return &BadRequest{jsonRes}
 }
 
+//
+// { "verb": "sendMessage", "from": <user-id>, "to": <name or profile id>, "message": <text> }
+// { "verb": "sendMessage", "from": <user-id>, "conversation": <conversation id>, "message": <text> }
+//
 func validateSendMessage(req *jsondata.JSONMap) Request {
     from, r1 := req.GetString("from") // hash value
     to, r2   := req.GetString("to")   // fb id
     msg, r3  := req.GetString("message")
+    conversation, r4 := req.GetString("conversation")
     
-    // additionally, we need to record the date and time of this response
-    
-    if !r1 || !r2 || !r3 || to == from || len(from) < 6 || len(to) < 6 || len(msg) == 0 {
+    // either a recipient or a conversation
+    if !r1 || !r3 || r2 == r4 || len(from) < 6 || len(msg) == 0 ||
+       (r2 && (to == from || len(to) < 6)) || (r4 && len(conversation) == 0) {
         jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in sendMessage request\"}"
         return &BadRequest{jsonRes}
     }
+    if len(msg) > MaxMessageLength || !acceptableMessage(msg) {
+        jsonRes := "{\"result\": false, \"answer\": \"message rejected by the content filter\"}"
+        return &BadRequest{jsonRes}
+    }
     
+    if r4 {
+        return datastore.NewSendConversationMessage(from, conversation, msg)
+    }
     return datastore.NewSendMessage(from, to, msg)
 }
 
+///////
+// Message moderation: content filters and per-sender rate limits. The
+// filters are configured with SetProfanityList and FilterURLs, the rate with
+// SetMessageRate.
+
+const MaxMessageLength = 512
+
+var (
+    profanities []string
+    urlPattern = regexp.MustCompile(`(https?://|www\.)|[a-z0-9\-]+\.(com|net|org|info|biz|ru|cn)([^a-z]|$)`)
+    FilterURLs = true
+)
+
+// SetProfanityList configures the words messages must not contain
+func SetProfanityList(words []string) {
+    profanities = make([]string, len(words))
+    for i, word := range words {
+        profanities[i] = strings.ToLower(word)
+    }
+}
+
+func acceptableMessage(msg string) bool {
+    msg = strings.ToLower(msg)
+    if FilterURLs && urlPattern.MatchString(msg) {
+        return false
+    }
+    for _, word := range strings.FieldsFunc(msg, notLetter) {
+        for _, profanity := range profanities {
+            if word == profanity {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func notLetter(c int) bool {
+    return !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c > 127)
+}
+
+// messageRate limits the messages a sender may send, keyed by the sender's
+// name once dispatch has authenticated them
+var messageRate = datastore.NewRateLimiter(10, 60)
+
+// SetMessageRate configures how many messages a sender may send per window
+func SetMessageRate(max int, window int64) {
+    messageRate.Set(max, window)
+}
+
+func validateBlockUser(req *jsondata.JSONMap) Request {
+    return validateBlockRequest(req, "blockUser", true)
+}
+
+func validateUnblockUser(req *jsondata.JSONMap) Request {
+    return validateBlockRequest(req, "unblockUser", false)
+}
+
+//
+// { "verb": "blockUser" | "unblockUser", "hash": <user-id>, "player": <name or profile id> }
+//
+func validateBlockRequest(req *jsondata.JSONMap, verb string, block bool) Request {
+    hash, r1 := req.GetString("hash")
+    player, r2 := req.GetString("player")
+    
+    if !r1 || !r2 || len(hash) < 6 || len(player) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in " + verb + " request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewBlockUser(hash, player, block)
+}
+
+func validateGetBlockedUsers(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getBlockedUsers request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewGetBlockedUsers(hash)
+}
+
+//
+// { "verb": "createConversation", "hash": <user-id>, "members": [one-or-more <name or profile id>], "title": <text> }
+//
+func validateCreateConversation(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    list, r2 := req.GetSlice("members")
+    title, _ := req.GetString("title")
+    
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in createConversation request\"}"
+    if !r1 || !r2 || len(hash) < 6 || list.Len() == 0 || list.Len() >= datastore.MAX_GROUP_MEMBERS || len(title) > 64 {
+        return &BadRequest{jsonRes}
+    }
+    
+    members := make([]string, list.Len())
+    for i := 0; i < list.Len(); i++ {
+        members[i] = list.GetString(i)
+    }
+    return datastore.NewCreateConversation(hash, members, title)
+}
+
+func validateListConversations(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in listConversations request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewListConversations(hash)
+}
+
+//
+// { "verb": "getConversation", "hash": <user-id>, "conversation": <conversation id>, "cursor": <cursor, optional>,
+//   "before": <time, optional>, "limit": <unsigned integer> }
+//
+func validateGetConversation(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    conversation, r2 := req.GetString("conversation")
+    cursor, _ := req.GetString("cursor")
+    before, _ := req.GetUInt("before")
+    limit, r3 := req.GetUInt("limit")
+    
+    if !r3 || limit <= 0 {
+        limit = DefaultReceiveLimit
+    }
+    if !r1 || !r2 || len(hash) < 6 || len(conversation) == 0 || before < 0 || limit > MaxReceiveLimit {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getConversation request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewGetConversation(hash, conversation, before, cursor, limit)
+}
+
+//
+// { "verb": "reportMessage", "hash": <user-id>, "id": <message id>, "reason": <text, optional> }
+//
+func validateReportMessage(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    id, r2 := req.GetString("id")
+    reason, _ := req.GetString("reason")
+    
+    if !r1 || !r2 || len(hash) < 6 || len(id) == 0 || len(reason) > MaxMessageLength {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in reportMessage request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewReportMessage(hash, id, reason)
+}
+
+
+const (
+    DefaultReceiveLimit = 20
+    MaxReceiveLimit     = 100
+    MaxReceiveWait      = 30 // seconds
+)
 
 func validateReceiveMessage(req *jsondata.JSONMap) Request {
     to, r1 := req.GetString("receiver") // hash of the receiver
-    limit, _ := req.GetUInt("limit") // ignored, at the moment
+    limit, r2 := req.GetUInt("limit")
+    wait, _ := req.GetUInt("wait")
     
-    // additionally, we need to record the date and time of this response
-    
-    if (!r1 || len(to) < 6) {
+    if !r2 || limit <= 0 {
+        limit = DefaultReceiveLimit
+    }
+    if (!r1 || len(to) < 6 || limit > MaxReceiveLimit || wait < 0 || wait > MaxReceiveWait) {
         jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in receiveMessage request\"}"
         return &BadRequest{jsonRes}
     }
     
-    return datastore.NewReceiveMessage(to, limit)
+    return datastore.NewReceiveMessage(to, limit, wait)
 }
 
+func validateAckMessages(req *jsondata.JSONMap) Request {
+    to, r1 := req.GetString("receiver") // hash of the receiver
+    list, r2 := req.GetSlice("ids")
+    
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in ackMessages request\"}"
+    if (!r1 || !r2 || len(to) < 6 || list.Len() == 0 || list.Len() > MaxReceiveLimit) {
+        return &BadRequest{jsonRes}
+    }
+    
+    ids := make([]string, list.Len())
+    for i := 0; i < list.Len(); i++ {
+        ids[i] = list.GetString(i)
+    }
+    return datastore.NewAckMessages(to, ids)
+}
+
+//
+// { "verb": "inviteFriend" | "acceptFriend" | "declineFriend" | "removeFriend", "hash": <user-id>, "player": <name or profile id> }
+//
+func validateFriendRequest(req *jsondata.JSONMap) Request {
+    verb, _ := req.GetString("verb")
+    hash, r1 := req.GetString("hash")
+    player, r2 := req.GetString("player")
+    
+    if !r1 || !r2 || len(hash) < 6 || len(player) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in " + verb + " request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewFriendRequest(verb, hash, player)
+}
+
+func validateListFriends(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in listFriends request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewListFriends(hash)
+}
+
+//
+// { "verb": "importFriends", "hash": <user-id>, "profile": "fb" | "tw" | "99", "ids": [one-or-more <profile id>] }
+//
+const MaxImportedFriends = 500
+
+func validateImportFriends(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    profile, r2 := req.GetString("profile")
+    list, r3 := req.GetSlice("ids")
+    
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in importFriends request\"}"
+    if !r1 || !r2 || !r3 || len(hash) < 6 || list.Len() == 0 || list.Len() > MaxImportedFriends {
+        return &BadRequest{jsonRes}
+    }
+    if profile != "fb" && profile != "tw" && profile != "99" {
+        return &BadRequest{jsonRes}
+    }
+    
+    ids := make([]string, list.Len())
+    for i := 0; i < list.Len(); i++ {
+        ids[i] = list.GetString(i)
+    }
+    return datastore.NewImportFriends(hash, profile, ids)
+}
+
+//
+// { "verb": "heartbeat", "hash": <user-id> }
+//
+func validateHeartbeat(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in heartbeat request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewHeartbeat(hash)
+}
+
+//
+// { "verb": "getOnlineStatus", "hash": <user-id>, "players": [one-or-more <name or profile id>] }
+//
+const MaxOnlineStatusPlayers = 100
+
+func validateGetOnlineStatus(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    list, r2 := req.GetSlice("players")
+    
+    if !r1 || !r2 || len(hash) < 6 || list.Len() == 0 || list.Len() > MaxOnlineStatusPlayers {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getOnlineStatus request\"}"
+        return &BadRequest{jsonRes}
+    }
+    
+    players := make([]string, list.Len())
+    for i := 0; i < list.Len(); i++ {
+        players[i] = list.GetString(i)
+    }
+    return datastore.NewGetOnlineStatus(hash, players)
+}
+
+//
+// { "verb": "getProfile", "hash": <user-id>, "player": <optional name or profile id> }
+//
+func validateGetProfile(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    player, _ := req.GetString("player")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in getProfile request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewGetProfile(hash, player)
+}
+
+const (
+    MinDisplayName = 3
+    MaxDisplayName = 32
+    MaxAvatarURL   = 256
+    MaxBio         = 256
+)
+
+var (
+    localePattern  = regexp.MustCompile(`^[a-z][a-z](_[A-Z][A-Z])?$`)
+    countryPattern = regexp.MustCompile(`^[A-Z][A-Z]$`)
+    httpURLPattern = regexp.MustCompile(`^https?://[^ ]+$`)
+)
+
+// validProfileField checks a value submitted for one of the profile fields.
+// Empty values clear the field, except for the display name.
+func validProfileField(field string, value string) bool {
+    switch field {
+    case "displayName":
+        n := len([]int(strings.TrimSpace(value)))
+        return n >= MinDisplayName && n <= MaxDisplayName && acceptableMessage(value) &&
+               !datastore.ReservedName(value)
+    case "avatarUrl":
+        return value == "" || len(value) <= MaxAvatarURL && httpURLPattern.MatchString(value)
+    case "locale":
+        return value == "" || localePattern.MatchString(value)
+    case "country":
+        return value == "" || countryPattern.MatchString(value)
+    case "bio":
+        return len([]int(value)) <= MaxBio && acceptableMessage(value)
+    }
+    return false
+}
+
+//
+// { "verb": "updateProfile", "hash": <user-id>, "displayName": <optional>, "avatarUrl": <optional>,
+//   "locale": <optional>, "country": <optional>, "bio": <optional>, "private": <optional [zero-or-more <field>]> }
+//
+func validateUpdateProfile(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in updateProfile request\"}"
+    
+    if !r1 || len(hash) < 6 {
+        return &BadRequest{jsonRes}
+    }
+    
+    changes := make(map[string]string)
+    for _, field := range append([]string{"displayName"}, datastore.ProfileFields...) {
+        if value, ok := req.GetString(field); ok {
+            if !validProfileField(field, value) {
+                return &BadRequest{"{\"result\": false, \"answer\": \"Invalid " + field + " in updateProfile request\"}"}
+            }
+            changes[field] = strings.TrimSpace(value), true
+        }
+    }
+    
+    var private []string
+    if list, ok := req.GetSlice("private"); ok {
+        private = make([]string, 0, list.Len())
+        for i := 0; i < list.Len(); i++ {
+            field := list.GetString(i)
+            known := false
+            for _, f := range datastore.ProfileFields {
+                known = known || f == field
+            }
+            if !known {
+                return &BadRequest{jsonRes}
+            }
+            private = append(private, field)
+        }
+    }
+    return datastore.NewUpdateProfile(hash, changes, private)
+}
+
+//
+// { "verb": "requestLinkCode", "hash": <user-id> }
+//
+func validateRequestLinkCode(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in requestLinkCode request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewRequestLinkCode(hash)
+}
+
+//
+// { "verb": "linkDevice", "code": <code>, "deviceId": <device>, "os": <os>, "osVersion": <version>,
+//   "density": <density>, "portraitX": <px>, "portraitY": <px>, "screenSize": <size> }
+// or, signing in from the new device, "name" and "password" instead of "code"
+//
+func validateLinkDevice(req *jsondata.JSONMap) Request {
+    code, r1 := req.GetString("code")
+    name, r2 := req.GetString("name")
+    password, r3 := req.GetString("password")
+    device, r4 := req.GetString("deviceId")
+    
+    if !r4 || len(device) < 6 || (r1 == (r2 && r3)) || (r1 && len(code) != 8) || (r2 && len(name) < 6) {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in linkDevice request\"}"
+        return &BadRequest{jsonRes}
+    }
+    
+    os, _ := req.GetString("os")
+    osVer, _ := req.GetString("osVersion")
+    density, _ := req.GetString("density")
+    portraitX, _ := req.GetUInt("portraitX")
+    portraitY, _ := req.GetUInt("portraitY")
+    screen, _ := req.GetString("screenSize")
+    if r1 {
+        return datastore.NewLinkDeviceByCode(code, device, os, osVer, portraitX, portraitY, density, screen)
+    }
+    return datastore.NewLinkDeviceBySignIn(name, password, device, os, osVer, portraitX, portraitY, density, screen)
+}
+
+//
+// { "verb": "listDevices", "hash": <user-id> }
+//
+func validateListDevices(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in listDevices request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewListDevices(hash)
+}
+
+//
+// { "verb": "unlinkDevice", "hash": <user-id>, "deviceId": <device> }
+//
+func validateUnlinkDevice(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    device, r2 := req.GetString("deviceId")
+    
+    if !r1 || !r2 || len(hash) < 6 || len(device) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in unlinkDevice request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewUnlinkDevice(hash, device)
+}
+
+//
+// { "verb": "registerGuest", "deviceId": <device>, "os": <os>, "osVersion": <version>,
+//   "density": <density>, "portraitX": <px>, "portraitY": <px>, "screenSize": <size> }
+//
+func validateRegisterGuest(req *jsondata.JSONMap) Request {
+    device, r1 := req.GetString("deviceId")
+    
+    if !r1 || len(device) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in registerGuest request\"}"
+        return &BadRequest{jsonRes}
+    }
+    
+    os, _ := req.GetString("os")
+    osVer, _ := req.GetString("osVersion")
+    density, _ := req.GetString("density")
+    portraitX, _ := req.GetUInt("portraitX")
+    portraitY, _ := req.GetUInt("portraitY")
+    screen, _ := req.GetString("screenSize")
+    return datastore.NewRegisterGuest(device, os, osVer, portraitX, portraitY, density, screen)
+}
+
+//
+// { "verb": "upgradeAccount", "hash": <guest user-id>, "name": <name>, "password": <password>,
+//   "profile": "fb" | "tw" | "99", "profileId": <optional id>, "accessToken": <required but for "99">,
+//   "displayName": <optional> }
+//
+func validateUpgradeAccount(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    name, r2 := req.GetString("name")
+    password, r3 := req.GetString("password")
+    profile, r4 := req.GetString("profile")
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in upgradeAccount request\"}"
+    
+    if !r1 || !r2 || !r3 || !r4 || len(hash) < 6 || len(name) < 6 || len(password) == 0 ||
+       datastore.ReservedName(name) {
+        return &BadRequest{jsonRes}
+    }
+    if profile != "fb" && profile != "tw" && profile != "99" {
+        return &BadRequest{jsonRes}
+    }
+    
+    displayName, _ := req.GetString("displayName")
+    if displayName != "" && !validProfileField("displayName", displayName) {
+        return &BadRequest{jsonRes}
+    }
+    profileId, _ := req.GetString("profileId")
+    token, _ := req.GetString("accessToken")
+    profileId, verified := verifyIdentity(profile, name, profileId, token)
+    if !verified {
+        return &BadRequest{"{\"result\": false, \"answer\": \"profile identity could not be verified\"}"}
+    }
+    return datastore.NewUpgradeAccount(hash, name, password, strings.TrimSpace(displayName), profile, profileId)
+}
+
+//
+// { "verb": "exportMyData", "hash": <user-id> }
+//
+func validateExportMyData(req *jsondata.JSONMap) Request {
+    hash, r1 := req.GetString("hash")
+    
+    if !r1 || len(hash) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in exportMyData request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewExportMyData(hash)
+}
+
+///////
+// Administration. Admin verbs carry the admin key instead of a user hash;
+// without a key configured, the admin API is disabled.
+
+var adminKey string
+
+func SetAdminKey(key string) {
+    adminKey = key
+}
+
+func validAdminKey(req *jsondata.JSONMap) bool {
+    key, ok := req.GetString("adminKey")
+    return ok && adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+var notAdmin = &BadRequest{"{\"result\": false, \"answer\": \"Not authorized\"}"}
+
+//
+// { "verb": "setAccountStatus", "adminKey": <key>, "player": <any identity>,
+//   "status": "active" | "suspended" | "banned" | "shadow", "until": <time, suspensions only> }
+//
+func validateSetAccountStatus(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    player, r1 := req.GetString("player")
+    status, r2 := req.GetString("status")
+    until, _ := req.GetUInt("until")
+    jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in setAccountStatus request\"}"
+    
+    if !r1 || !r2 || len(player) < 6 {
+        return &BadRequest{jsonRes}
+    }
+    switch status {
+    case "active":
+        status, until = datatypes.AccountActive, 0
+    case datatypes.AccountSuspended:
+        if until == 0 {
+            return &BadRequest{jsonRes}
+        }
+    case datatypes.AccountBanned, datatypes.AccountShadow:
+        until = 0
+    default:
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewSetAccountStatus(player, status, int64(until))
+}
+
+func validateAcceptScore(req *jsondata.JSONMap) Request {
+    return validateReviewScore(req, "acceptScore", true)
+}
+
+func validateRejectScore(req *jsondata.JSONMap) Request {
+    return validateReviewScore(req, "rejectScore", false)
+}
+
+//
+// { "verb": "acceptScore" | "rejectScore", "adminKey": <key>, "player": <any identity>, "game": <game> }
+//
+func validateReviewScore(req *jsondata.JSONMap, verb string, accept bool) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    player, r1 := req.GetString("player")
+    game, r2 := req.GetString("game")
+    
+    if !r1 || !r2 || len(player) < 6 || len(game) == 0 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in " + verb + " request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewReviewScore(player, game, accept)
+}
+
+//
+// { "verb": "setScoreRule", "adminKey": <key>, "game": <game>, "minScore": <n>, "maxScore": <n, 0 for none>,
+//   "maxPointsPerSecond": <n, 0 for any>, "minRunSeconds": <seconds>, "requireRun": <bool> }
+//
+func validateSetScoreRule(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    game, r1 := req.GetString("game")
+    minScore, _ := req.GetUInt("minScore")
+    maxScore, _ := req.GetUInt("maxScore")
+    maxRate, _ := req.GetUInt("maxPointsPerSecond")
+    minRun, _ := req.GetUInt("minRunSeconds")
+    requireRun, _ := req.GetBool("requireRun")
+    
+    if !r1 || len(game) == 0 || (maxScore > 0 && maxScore < minScore) {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in setScoreRule request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewSetScoreRule(datatypes.ScoreRule{game, minScore, maxScore, maxRate, int64(minRun), requireRun})
+}
+
+//
+// { "verb": "defineAchievement", "adminKey": <key>, "game": <game>, "id": <id>, "title": <title>,
+//   "description": <text>, "points": <points>, "hidden": <bool>, "target": <count>,
+//   "rule": <optional rule>, "threshold": <value> }
+//
+func validateDefineAchievement(req *jsondata.JSONMap) Request {
+    if !validAdminKey(req) {
+        return notAdmin
+    }
+    game, r1 := req.GetString("game")
+    id, r2 := req.GetString("id")
+    title, r3 := req.GetString("title")
+    description, _ := req.GetString("description")
+    points, _ := req.GetUInt("points")
+    hidden, _ := req.GetBool("hidden")
+    target, _ := req.GetUInt("target")
+    rule, _ := req.GetString("rule")
+    threshold, _ := req.GetUInt("threshold")
+    
+    validRule := rule == "" || rule == datatypes.RuleScore || rule == datatypes.RuleCoinsDonated ||
+                 rule == datatypes.RuleMessagesSent
+    if !r1 || !r2 || !r3 || len(game) == 0 || len(id) == 0 || !validRule {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in defineAchievement request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewDefineAchievement(datatypes.AchievementDef{game, id, title, description, points, hidden,
+                                                                   target, rule, threshold})
+}
+
+//
+// { "verb": "requestPasswordReset", "player": <name or profile id> }
+//
+func validateRequestPasswordReset(req *jsondata.JSONMap) Request {
+    player, r1 := req.GetString("player")
+    
+    if !r1 || len(player) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in requestPasswordReset request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewRequestPasswordReset(player)
+}
+
+//
+// { "verb": "verifyResetCode", "player": <name or profile id>, "code": <code> }
+//
+func validateVerifyResetCode(req *jsondata.JSONMap) Request {
+    player, r1 := req.GetString("player")
+    code, r2 := req.GetString("code")
+    
+    if !r1 || !r2 || len(player) < 6 || len(code) != 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in verifyResetCode request\"}"
+        return &BadRequest{jsonRes}
+    }
+    return datastore.NewVerifyResetCode(player, code)
+}
+
+//
+// { "verb": "resetPassword", "token": <reset token>, "password": <new password>, "deviceId": <device>,
+//   "os": <os>, "osVersion": <version>, "density": <density>, "portraitX": <px>, "portraitY": <px>,
+//   "screenSize": <size> }
+//
+func validateResetPassword(req *jsondata.JSONMap) Request {
+    token, r1 := req.GetString("token")
+    password, r2 := req.GetString("password")
+    device, r3 := req.GetString("deviceId")
+    
+    if !r1 || !r2 || !r3 || len(token) == 0 || len(password) == 0 || len(device) < 6 {
+        jsonRes := "{\"result\": false, \"answer\": \"Missing or Invalid data in resetPassword request\"}"
+        return &BadRequest{jsonRes}
+    }
+    
+    os, _ := req.GetString("os")
+    osVer, _ := req.GetString("osVersion")
+    density, _ := req.GetString("density")
+    portraitX, _ := req.GetUInt("portraitX")
+    portraitY, _ := req.GetUInt("portraitY")
+    screen, _ := req.GetString("screenSize")
+    return datastore.NewResetPassword(token, password, device, os, osVer, portraitX, portraitY, density, screen)
+}
@@ -0,0 +1,65 @@
+package cloud
+
+import (
+    "fmt"
+    "http"
+    "strings"
+    "testing"
+)
+
+func TestAcceptableMessage(t *testing.T) {
+    SetProfanityList([]string{"Darn", "heck"})
+    defer SetProfanityList(nil)
+
+    tests := []struct {
+        msg        string
+        filterURLs bool
+        acceptable bool
+    }{
+        {"good game!", true, true},
+        {"oh DARN it", true, false},
+        {"what the heck.", true, false},
+        {"darned luck", true, true},   // whole words only
+        {"checking in", true, true},
+        {"visit http://cheats.example", true, false},
+        {"www.cheats", true, false},
+        {"get coins at cheats.com now", true, false},
+        {"get coins at cheats.com now", false, true},
+        {"version 1.2 is out", true, true},
+    }
+    defer func() { FilterURLs = true }()
+    for _, test := range tests {
+        FilterURLs = test.filterURLs
+        if acceptable := acceptableMessage(test.msg); acceptable != test.acceptable {
+            t.Errorf("acceptableMessage(%q), filtering urls %v = %v, want %v", test.msg, test.filterURLs,
+                     acceptable, test.acceptable)
+        }
+    }
+}
+
+func TestHTTPRequestReader(t *testing.T) {
+    ids := make([]string, MaxImportedFriends)
+    for i := range ids {
+        ids[i] = fmt.Sprintf("\"%020d\"", i)
+    }
+    big := `{"verb": "importFriends", "hash": "abcdef", "profile": "fb", "ids": [` + strings.Join(ids, ", ") + `]}`
+
+    tests := []struct {
+        body string
+        want int
+    }{
+        {`{"verb": "heartbeat", "hash": "abcdef"}`, 39},
+        {big, len(big)},
+        {strings.Repeat(" ", MaxRequestSize+1024), MaxRequestSize},
+    }
+    reader := &HTTPRequestReader{}
+    for _, test := range tests {
+        req, err := http.NewRequest("POST", "http://localhost/", strings.NewReader(test.body))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := len(reader.Read(req)); got != test.want {
+            t.Errorf("Read(%d bytes) = %d bytes, want %d", len(test.body), got, test.want)
+        }
+    }
+}
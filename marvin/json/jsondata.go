@@ -72,6 +72,11 @@ func (jsonObj *JSONMap) GetString(name string) (s string, r bool) {
     return strings.TrimSpace(s), r
 }
 
+// SetString replaces the value of a field
+func (jsonObj *JSONMap) SetString(name string, s string) {
+    jsonObj.mapp.SetMapIndex(reflect.ValueOf(name), reflect.ValueOf(s))
+}
+
 func (jsonObj *JSONMap) GetUInt(name string) (i int, r bool) {
 	i = 0
     r = false
@@ -98,6 +103,20 @@ func (jsonObj *JSONMap) GetUInt(name string) (i int, r bool) {
     return i, r
 }
 
+func (jsonObj *JSONMap) GetBool(name string) (b bool, r bool) {
+	b = false
+	r = false
+	
+    val := jsonObj.mapp.MapIndex(reflect.ValueOf(name));
+    if val.IsValid() && !val.IsNil() {
+        if val.Kind() == reflect.Interface && val.Elem().Kind() == reflect.Bool {
+            b = val.Elem().Bool()
+            r = true
+        }
+    }
+    return b, r
+}
+
 func (jsonObj *JSONMap) GetSlice(name string) (o *JSONSlice, r bool) {
 	o = nil
 	r = false
@@ -2,11 +2,21 @@ package datastore
 
 import (
     "fmt"
+    "os"
     "marvin/store/datatypes"
+    "marvin/store/hub"
     "launchpad.net/gobson/bson"
     "launchpad.net/mgo"
     "json"
     "strconv"
+    "strings"
+    "sync"
+    "time"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/hex"
+    "hash/crc32"
 )
 
 // FIXME: this has to be passed as a configuration parameter to Marvin
@@ -16,7 +26,23 @@ const REGISTERED_USERS         =    "RegisteredUsers"
 const REGISTERED_DEVICES       =    "RegisteredDevices"
 const PENDING_COIN_REQUESTS    =    "OpenCoinRequests"
 const GAME_SCORES              =    "GameScores"
+const QUARANTINED_SCORES       =    "QuarantinedScores"
+const SCORE_RULES              =    "ScoreRules"
 const TEXT_MESSAGES            =    "TextMessages"
+const GAME_RUNS                =    "GameRuns"
+const ACHIEVEMENT_CATALOG      =    "AchievementCatalog"
+const USER_ACHIEVEMENTS        =    "UserAchievements"
+const BLOCKED_USERS            =    "BlockedUsers"
+const MESSAGE_REPORTS          =    "MessageReports"
+const CONVERSATIONS            =    "Conversations"
+const CONVERSATION_MESSAGES    =    "ConversationMessages"
+const CONVERSATION_READS       =    "ConversationReads"
+const FRIENDSHIPS              =    "Friendships"
+const LINK_CODES               =    "LinkCodes"
+const PASSWORD_RESETS          =    "PasswordResets"
+const RELEASE_MANIFESTS        =    "ReleaseManifests"
+const RESOURCE_BUNDLES         =    "ResourceBundles"
+const GAME_CONFIG              =    "GameConfig"
 
 type DBSession struct {
     url string
@@ -38,15 +64,22 @@ type UserDevice struct {
     datatypes.Device
 }
 
-func NewUserDevice(name string, displayName string, password string, device string, hash string, profile string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *UserDevice {
+func NewUserDevice(name string, displayName string, password string, device string, hash string, profile string, profileId string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *UserDevice {
     //var achievements []string
-    return &UserDevice{datatypes.User{name, displayName, password, device, hash, profile, 0, 0, 0, 0}, datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen}}
+    user := datatypes.User{name, displayName, password, device, hash, profile, profileId, 0, 0, 0, 0, 0, "", "", "", "", DisplayKey(displayName), nil, datatypes.AccountActive, 0}
+    return &UserDevice{user, datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen, name, time.Seconds(), ""}}
 }
 
 func (ud *UserDevice) Perform() datatypes.Response {
     //fmt.Println("Registration::Perform --> ", reg.Name, reg.Password)
     jsonRes := "{\"result\": false, \"answer\": \"User registration attempt failed\" }"
     
+    hashed, err := HashPassword(ud.Password)
+    if err != nil {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    ud.Password = hashed
+    
     dataStore := NewSession()
     defer dataStore.Close()
     
@@ -69,8 +102,12 @@ func (session *DBSession) registerUser(user *datatypes.User) (r bool) {
     if err == nil && count == 0 { /* no hash duplicates */
         query = c.Find(bson.M{"name": user.Name})
         count, err = query.Count()
-        if err == nil && count == 0 { /* no name duplicates */
+        if err == nil && count == 0 && user.DisplayKey != "" { /* no name duplicates */
+            count, err = c.Find(bson.M{"displaykey": user.DisplayKey}).Count()
+        }
+        if err == nil && count == 0 { /* no display name duplicates either */
 	        if err = c.Insert(user); err == nil {
+	            forgetAccount(user.Hash)  /* may have been cached as unknown */
 	            r = true  /* everything's fine! */
 	        }
 	    }
@@ -78,11 +115,11 @@ func (session *DBSession) registerUser(user *datatypes.User) (r bool) {
     return r
 }
 
-// we allow multiple registrations for the same device
+// we allow multiple registrations for the same device, one per owner
 func (session *DBSession) registerDevice(device *datatypes.Device) (r bool) {
     r = true
     c := session.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES)
-    query := c.Find(bson.M{"deviceid":device.DeviceId})
+    query := c.Find(bson.M{"deviceid":device.DeviceId, "owner": device.Owner})
     count, err := query.Count()
      /* We DO NOT upset an existing entry (if count > 0) */
     if err == nil && count == 0 {
@@ -129,11 +166,8 @@ func (req *UnregisterRequest) Perform() datatypes.Response {
     
     jsonRes = "{\"result\": true, \"answer\": \"Generic datastore error\" }"
    
-    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
-    user := bson.M{"hash": req.hash, "name": req.name}
-    n, err := users.Find(user).Count()
-    if err == nil && n == 1 {
-        users.Remove(user)
+    if user, found := ds.findUser(bson.M{"hash": req.hash, "name": req.name}); found {
+        ds.deleteUser(user)
         jsonRes = "{\"result\": true, \"answer\": \"\" }"
         fmt.Printf("User %s unregistered!", req.name)
     }
@@ -152,6 +186,7 @@ type SetScoreRequest struct {
     hash string
     game string
     score int
+    run string
 }
 
 func NewGetScoreRequest(hash string, game string) *GetScoreRequest {
@@ -159,7 +194,11 @@ func NewGetScoreRequest(hash string, game string) *GetScoreRequest {
 }
 
 func NewSetScoreRequest(hash string, game string, score int) *SetScoreRequest {
-   return &SetScoreRequest{hash, game, score}
+   return &SetScoreRequest{hash, game, score, ""}
+}
+
+func NewEndRunRequest(hash string, game string, run string, score int) *SetScoreRequest {
+   return &SetScoreRequest{hash, game, score, run}
 }
 
 func (req *GetScoreRequest) Perform() datatypes.Response {
@@ -194,78 +233,257 @@ func (req *SetScoreRequest) Perform() datatypes.Response {
     ds := NewSession()
     defer ds.Close()
 
-    if !ds.validUserHash(req.hash) {
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    rule := ScoreRuleFor(req.game)
+    if rule.RequireRun && req.run == "" {
+        jsonRes = "{\"result\": false, \"answer\": \"Scores of this game must be submitted with endRun\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
     
-    jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
     scorees := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES);
-    change := mgo.Change{Update: bson.M{"$set": bson.M{"score": req.score}}, Upsert: true}
+    now := time.Seconds()
+    
+    // points scored and the time taken to score them, as far as we can tell
+    points, elapsed := 0, int64(-1)
+    if req.run != "" {
+        started, ok := ds.finishRun(req.run, req.hash, req.game)
+        if !ok {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown run specified in endRun request\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        points, elapsed = req.score, now - started
+    } else {
+        var previous interface{}
+        err := scorees.Find(bson.M{"hash": req.hash, "game": req.game}).
+                         Select(bson.M{"score": 1, "updated": 1, "_id": 0}).One(&previous)
+        if data, ok := previous.(bson.M); err == nil && ok {
+            oldScore, _ := data["score"].(int)
+            updated, _ := data["updated"].(int64)
+            if updated > 0 && req.score > oldScore {
+                points, elapsed = req.score - oldScore, now - updated
+            }
+        }
+    }
+    quarantined := req.run != "" && elapsed < rule.MinRunSeconds
+    quarantined = quarantined || !plausibleScore(rule, req.hash, req.game, req.score, points, elapsed)
+    
+    jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+    if quarantined {
+        // held back, the player keeps their current score until the review
+        held := datatypes.QuarantinedScore{req.hash, req.game, req.score, now}
+        if ds.DB(GUSTO_DB_NAME).C(QUARANTINED_SCORES).Upsert(bson.M{"hash": req.hash, "game": req.game}, &held) == nil {
+            fmt.Printf("SetScore: quarantined score %d of %s in %s\n", req.score, req.hash, req.game)
+            jsonRes = "{\"result\": true, \"answer\": \"score submitted for review\"}"
+        }
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    shadow := user.Status == datatypes.AccountShadow
+    change := mgo.Change{Update: bson.M{"$set": bson.M{"score": req.score, "updated": now, "shadow": shadow}}, Upsert: true}
     
     var result interface{}
     err := scorees.Find(bson.M{"hash": req.hash, "game": req.game}).Modify(change, &result)
     if err == nil {
-        jsonRes = "{\"result\": true, \"answer\": \"\"}"
+        InvalidateLeaderBoard(req.game)
+        oldScore := 0
+        if data, ok := result.(bson.M); ok {
+            oldScore, _ = data["score"].(int)
+        }
+        if !shadow {
+            ds.notifyBeatenPlayers(user, req.game, oldScore, req.score)
+        }
+        unlocked := ds.evaluateAchievementRules(req.hash, datatypes.RuleScore, req.game, req.score)
+        jsonRes = "{\"result\": true, \"answer\": \"\", \"unlocked\": " + marshalList(unlocked) + "}"
     }
     
     return &datatypes.GenericResponse{jsonRes}
 }
 
-//////
-type GetAchievementsRequest struct {
-    hash string
-}
+// notifyBeatenPlayers lets the players overtaken by a new high score know
+const MAX_BEATEN_NOTIFICATIONS = 5
 
-func NewGetAchievementRequest(hash string) *GetAchievementsRequest {
-    return &GetAchievementsRequest{hash}
-}
+func (ds *DBSession) notifyBeatenPlayers(user *datatypes.User, game string, oldScore int, newScore int) {
+    if newScore <= oldScore {
+        return
+    }
 
-type SetAchievementRequest struct {
-    hash string
-    achievement int
+    gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
+    query := gameScores.Find(bson.M{"game": game, "shadow": bson.M{"$ne": true}, "hash": bson.M{"$ne": user.Hash},
+                                    "score": bson.M{"$gte": oldScore, "$lt": newScore}}).
+                        Sort(bson.M{"score": -1}).Limit(MAX_BEATEN_NOTIFICATIONS).
+                            Select(bson.M{"hash": 1, "_id": 0})
+    var hashes []string
+    iterate(query, func(doc bson.M) {
+        if hash, ok := doc["hash"].(string); ok {
+            hashes = append(hashes, hash)
+        }
+    })
+
+    for _, beaten := range ds.usersByHash(hashes) {
+        name, _ := beaten["name"].(string)
+        ds.postSystemMessage(user.Name, name, datatypes.MessageScoreBeaten,
+                             user.Name + " beat your high score in " + game,
+                             bson.M{"by": user.Name, "game": game, "score": newScore})
+    }
 }
 
-func NewSetAchievementRequest(hash string, achieved int) *SetAchievementRequest {
-    return &SetAchievementRequest{hash, achieved}
+///////
+// Score validation. Every game can declare a datatypes.ScoreRule; on top of
+// it, cheat detection hooks can veto any submitted score. Scores that fail
+// the checks are held back in their own collection until reviewed, and
+// never replace the player's current score in the meantime.
+//
+// The rules are set with the setScoreRule admin verb, and loaded from the
+// datastore on first use.
+
+var scoreRules = struct {
+    sync.RWMutex
+    loaded bool
+    byGame map[string]datatypes.ScoreRule
+    checks []ScoreCheck
+}{byGame: make(map[string]datatypes.ScoreRule)}
+
+// ScoreCheck is a cheat detection hook. It is given the points scored since
+// the last submission (or during the run) and the seconds it took, -1 when
+// unknown, and returns false if the score looks forged.
+type ScoreCheck func(hash string, game string, score int, points int, elapsed int64) bool
+
+// SetScoreRule installs the rule of a game in this process; the setScoreRule
+// verb also stores it.
+func SetScoreRule(game string, rule datatypes.ScoreRule) {
+    scoreRules.Lock()
+    defer scoreRules.Unlock()
+    rule.Game = game
+    scoreRules.byGame[game] = rule
 }
 
-func (req *GetAchievementsRequest) Perform() datatypes.Response {
+func ScoreRuleFor(game string) datatypes.ScoreRule {
+    scoreRules.RLock()
+    rule, loaded := scoreRules.byGame[game], scoreRules.loaded
+    scoreRules.RUnlock()
+    if loaded {
+        return rule
+    }
+
     ds := NewSession()
     defer ds.Close()
-    
-    isHash := false
-    isName := ds.validUser(req.hash)
-    if !isName {
-        isHash = ds.validUserHash(req.hash)
+    ds.loadScoreRules()
+
+    scoreRules.RLock()
+    defer scoreRules.RUnlock()
+    return scoreRules.byGame[game]
+}
+
+// loadScoreRules reads the stored rules, but for the games whose rule was
+// set in the meantime
+func (ds *DBSession) loadScoreRules() {
+    var rules []datatypes.ScoreRule
+    iter, err := ds.DB(GUSTO_DB_NAME).C(SCORE_RULES).Find(nil).Iter()
+    if err != nil {
+        return
     }
-    if !isName || !isHash {
-        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
-        return &datatypes.GenericResponse{jsonRes}
+    for {
+        var rule datatypes.ScoreRule
+        if iter.Next(&rule) != nil {
+            break
+        }
+        rules = append(rules, rule)
     }
-    
-    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
-    var result interface{}
-    query := users.Find(bson.M{"name": req.hash})
-    if (isHash) {
-        query = users.Find(bson.M{"hash": req.hash})
+
+    scoreRules.Lock()
+    defer scoreRules.Unlock()
+    if scoreRules.loaded {
+        return
     }
-    err := query.Select(bson.M{"achievements": 1, "_id": 0}).One(&result)
-    jsonRes := "{\"result\": false , \"answer\": \"Unknown error\"}"
-    if err == nil {
-        if mapp, ok := result.(bson.M); ok {
-            achievements := mapp["achievements"]
-            fmt.Printf("    GetAchievementsRequest: %v\n", achievements)
-            if data, err := json.Marshal(achievements); err == nil {
-                jsonRes = "{\"result\": true , \"answer\":" + string(data) + "}"
-            }
+    for _, rule := range rules {
+        if _, found := scoreRules.byGame[rule.Game]; !found {
+            scoreRules.byGame[rule.Game] = rule
         }
     }
-    
-    fmt.Printf("    %s\n", jsonRes)
-    return &datatypes.GenericResponse{jsonRes}
+    scoreRules.loaded = true
 }
-    
-func (req *SetAchievementRequest) Perform() datatypes.Response {
+
+func AddScoreCheck(check ScoreCheck) {
+    scoreRules.Lock()
+    defer scoreRules.Unlock()
+    scoreRules.checks = append(scoreRules.checks, check)
+}
+
+// ValidScore checks a score against the bounds of its game
+func ValidScore(game string, score int) bool {
+    rule := ScoreRuleFor(game)
+    if score < rule.MinScore || (rule.MaxScore > 0 && score > rule.MaxScore) {
+        return false
+    }
+    return true
+}
+
+func plausibleScore(rule datatypes.ScoreRule, hash string, game string, score int, points int, elapsed int64) bool {
+    if elapsed >= 0 && rule.MaxPointsPerSecond > 0 {
+        if int64(points) > int64(rule.MaxPointsPerSecond) * elapsed {
+            return false
+        }
+    }
+    scoreRules.RLock()
+    checks := scoreRules.checks
+    scoreRules.RUnlock()
+    for _, check := range checks {
+        if !check(hash, game, score, points, elapsed) {
+            return false
+        }
+    }
+    return true
+}
+
+// ReviewScore replaces the player's score with the one held back for review,
+// or drops the held back score when it is rejected.
+func (ds *DBSession) ReviewScore(hash string, game string, accept bool) bool {
+    quarantine := ds.DB(GUSTO_DB_NAME).C(QUARANTINED_SCORES)
+    selector := bson.M{"hash": hash, "game": game}
+
+    var held datatypes.QuarantinedScore
+    if quarantine.Find(selector).Sort(bson.M{"submitted": -1}).One(&held) != nil {
+        return false
+    }
+    quarantine.RemoveAll(selector)
+    if !accept {
+        return true
+    }
+
+    user, ok := ds.caller(hash)
+    if !ok {
+        return false
+    }
+    shadow := user.Status == datatypes.AccountShadow
+    err := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES).Upsert(selector,
+                  bson.M{"$set": bson.M{"score": held.Score, "updated": held.Submitted, "shadow": shadow}})
+    if err != nil {
+        return false
+    }
+    InvalidateLeaderBoard(game)
+    ds.evaluateAchievementRules(hash, datatypes.RuleScore, game, held.Score)
+    return true
+}
+
+//////
+type StartRunRequest struct {
+    hash string
+    game string
+}
+
+func NewStartRunRequest(hash string, game string) *StartRunRequest {
+    return &StartRunRequest{hash, game}
+}
+
+//
+// { "verb": "startRun", "hash": <user-id>, "game": <game name> }
+// { "result": true, "answer" : <run token> }
+//
+func (req *StartRunRequest) Perform() datatypes.Response {
     jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
     
     ds := NewSession()
@@ -275,164 +493,675 @@ func (req *SetAchievementRequest) Perform() datatypes.Response {
         return &datatypes.GenericResponse{jsonRes}
     }
     
-    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
-    user := users.Find(bson.M{"hash": req.hash})
+    jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+    run := datatypes.GameRun{newToken(), req.hash, req.game, time.Seconds()}
     
-    change := mgo.Change{Update: bson.M{"$set": bson.M{"achievements": 
-                                                             req.achievement}}}
-    var doc interface{}
-    if user.Modify(change, &doc) == nil {
-        jsonRes = "{\"result\": true, \"answer\": \"set achievement succeeded\"}"
-    } else {
-        jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+    // a player has at most one open run per game
+    runs := ds.DB(GUSTO_DB_NAME).C(GAME_RUNS)
+    runs.RemoveAll(bson.M{"hash": req.hash, "game": req.game})
+    if runs.Insert(&run) == nil {
+        jsonRes = "{\"result\": true, \"answer\": \"" + run.Token + "\"}"
     }
     
     return &datatypes.GenericResponse{jsonRes}
 }
 
-/////
-type GetCoinCountRequest struct {
-    name string
+// finishRun closes an open run and returns the time it was started at
+func (ds *DBSession) finishRun(token string, hash string, game string) (started int64, ok bool) {
+    runs := ds.DB(GUSTO_DB_NAME).C(GAME_RUNS)
+    selector := bson.M{"token": token, "hash": hash, "game": game}
+    
+    // removed as it is read, so that a run only ever ends once
+    var run datatypes.GameRun
+    if runs.Find(selector).Modify(mgo.Change{Remove: true}, &run) != nil {
+        return 0, false
+    }
+    return run.Started, true
 }
 
-func NewGetCoinCount(name string) *GetCoinCountRequest {
-    return &GetCoinCountRequest{name}
+// newToken returns a random, hex encoded, 128 bit token
+func newToken() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        // fall back to something unique, if not unpredictable
+        return strconv.Itoa64(time.Nanoseconds())
+    }
+    return hex.EncodeToString(b)
 }
 
-func (req *GetCoinCountRequest) Perform() datatypes.Response {
-    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
-    
-    ds := NewSession()
-    defer ds.Close()
+// newSecret returns a random, hex encoded, 128 bit token for credentials,
+// which cannot do with a predictable one
+func newSecret() (string, os.Error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
 
-    if !ds.validUser(req.name) {
-        return &datatypes.GenericResponse{jsonRes}
+// Passwords are stored salted and hashed, as "sha1$<salt>$<digest>". Records
+// from before keep the plain password until it is next checked successfully.
+const PASSWORD_SCHEME = "sha1$"
+const PASSWORD_ROUNDS = 1000
+
+// HashPassword returns the password as stored, "" for no password
+func HashPassword(password string) (string, os.Error) {
+    if password == "" {
+        return "", nil
     }
-    
-    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
-    query := users.Find(bson.M{"name": req.name}).Select(bson.M{"borrowed": 1, "earned": 1, "_id": 0})
-    
-    var result interface{}
-    
-    jsonRes = "{\"result\": false, \"answer\": 0 }"
-    if query.One(&result) == nil {
-        // coin count = borrowed + earned
-        if data, ok := result.(bson.M); ok {
-            borrowed := data["borrowed"].(int)
-            earned := data["earned"].(int)
-            count := borrowed + earned
-            jsonRes = "{\"result\": true, \"answer\": " + strconv.Itoa(count) + "}"
+    salt, err := newSecret()
+    if err != nil {
+        return "", err
+    }
+    return PASSWORD_SCHEME + salt + "$" + passwordDigest(salt, password), nil
+}
+
+func passwordDigest(salt string, password string) string {
+    digest := []byte(salt + password)
+    for i := 0; i < PASSWORD_ROUNDS; i++ {
+        hasher := sha1.New()
+        hasher.Write(digest)
+        hasher.Write([]byte(password))
+        digest = hasher.Sum()
+    }
+    return hex.EncodeToString(digest)
+}
+
+// checkPassword tells whether the password matches the stored one. No
+// password ever matches an account without one.
+func checkPassword(stored string, password string) bool {
+    if stored == "" || password == "" {
+        return false
+    }
+    expected := password
+    if strings.HasPrefix(stored, PASSWORD_SCHEME) {
+        parts := strings.Split(stored[len(PASSWORD_SCHEME):], "$")
+        if len(parts) != 2 {
+            return false
         }
+        stored, expected = parts[1], passwordDigest(parts[0], password)
     }
-    
-    return &datatypes.GenericResponse{jsonRes}
+    return subtle.ConstantTimeCompare([]byte(stored), []byte(expected)) == 1
+}
+
+// signIn checks the password of a user, and stores a plain password hashed
+func (ds *DBSession) signIn(user *datatypes.User, password string) bool {
+    if !checkPassword(user.Password, password) {
+        return false
+    }
+    if !strings.HasPrefix(user.Password, PASSWORD_SCHEME) {
+        if hashed, err := HashPassword(password); err == nil {
+            users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+            users.Update(bson.M{"hash": user.Hash, "password": user.Password}, bson.M{"$set": bson.M{"password": hashed}})
+        }
+    }
+    return true
 }
 
 //////
-type GetPendingCoinRequest struct {
+type GetAchievementsRequest struct {
     hash string
-    limit int
+    player string /* another player, by any of its identities */
+    game string /* all games if empty */
 }
 
-func NewGetPendingCoinRequests(hash string, limit int) *GetPendingCoinRequest {
-    return &GetPendingCoinRequest{hash, limit}
+func NewGetAchievementRequest(hash string, player string, game string) *GetAchievementsRequest {
+    return &GetAchievementsRequest{hash, player, game}
+}
+
+type SetAchievementRequest struct {
+    hash string
+    game string
+    achievement string
+}
+
+func NewSetAchievementRequest(hash string, game string, achievement string) *SetAchievementRequest {
+    return &SetAchievementRequest{hash, game, achievement}
+}
+
+// Achievements set by the clients predating the catalog are plain numbers,
+// recorded outside of any game and without a definition.
+const LEGACY_ACHIEVEMENT_GAME = ""
+
+func NewLegacySetAchievementRequest(hash string, achievement int) *SetAchievementRequest {
+    return &SetAchievementRequest{hash, LEGACY_ACHIEVEMENT_GAME, strconv.Itoa(achievement)}
+}
+
+type GetAchievementCatalogRequest struct {
+    hash string
+    game string
+}
+
+func NewGetAchievementCatalogRequest(hash string, game string) *GetAchievementCatalogRequest {
+    return &GetAchievementCatalogRequest{hash, game}
 }
 
 //
-// { "verb": "getPendingCoinRequests", "hash": <user-id>, "limit": <unsigned integer> }
-// { "result": true, "answer" : [zero-or-more{"name": <name>, "count": <unsigned int>}] }
+// { "verb": "getAchievements", "hash": <user-id>, "player": <name or profile id, optional>, "game": <game name, optional> }
+// { "result": true, "answer": [zero-or-more{"game": <game>, "id": <id>, "title": <title>, "description": <text>, "points": <int>,
+//                                           "progress": <int>, "target": <int>, "percent": <0-100>, "unlocked": <time or 0>}] }
 //
-func (req *GetPendingCoinRequest) Perform() datatypes.Response {
-    //jsonRes := "{\"result\": false, \"answer\": []"}"
+// Only unlocked achievements that are not hidden are public to other players.
+func (req *GetAchievementsRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
     
     ds := NewSession()
     defer ds.Close()
-
-    if !ds.validUserHash(req.hash) {
-        jsonRes := "{\"result\": false, \"answer\": []}"
-        return &datatypes.GenericResponse{jsonRes}
-    }
     
-    coinRequests := ds.DB(GUSTO_DB_NAME).C(PENDING_COIN_REQUESTS);
-    requestsForDonor := coinRequests.Find(bson.M{"donorhash": req.hash})
-    //query := requests.Find(bson.M{"donorhash": req.hash}).
-    query := requestsForDonor.
-                         Select(bson.M{"_id": 0, "requester": 1, "ask" : 1})
-    count, err := query.Count()
-    if err == nil && count == 0 {
-        jsonRes := "{\"result\": true, \"answer\": []}"
+    user, ok := ds.caller(req.hash)
+    if !ok {
         return &datatypes.GenericResponse{jsonRes}
     }
-    fmt.Printf("GetPendingCoinRequests: %d\n", count)
     
-    mapRes := "[ "
-    if iter, err := query.Iter(); err == nil {
-        var result interface{}
-        firstItem := true
-        
-        for {
-            result = nil
-            if err = iter.Next(&result); err != nil {
-                break
-            }
-            if data, err := json.Marshal(result); err == nil {
-                if !firstItem { mapRes += ", " }
-                mapRes += string(data)
-                firstItem = false
-            }
+    public := false
+    if req.player != "" {
+        player, found := ds.lookupUser(req.player)
+        if !found {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown player specified in getAchievements request\"}"
+            return &datatypes.GenericResponse{jsonRes}
         }
-        // DO NOT DO THE FOLLOWING, STUPID!! 
-        // remove the requests from the collection
-        coinRequests.RemoveAll(bson.M{"donorhash": req.hash})
+        public = player.Hash != user.Hash
+        user = player
     }
-    mapRes += " ]"
     
-    jsonRes := "{\"result\": true, \"answer\":" + mapRes + "}"
+    achievements := ds.userAchievements(user.Hash, req.game)
+    if public {
+        achievements = publicAchievements(achievements)
+    }
+    for _, a := range achievements {
+        a["hidden"] = nil, false
+    }
+    jsonRes = jsonAnswer(achievements)
     
     fmt.Printf("    %s\n", jsonRes)
     return &datatypes.GenericResponse{jsonRes}
 }
 
-///////
-type SyncCoinCounts struct {
-    hash string
-    count int
+// publicAchievements keeps the achievements other players may see: the
+// unlocked ones, but the hidden ones. Legacy unlocks are never hidden.
+func publicAchievements(achievements []bson.M) []bson.M {
+    visible := make([]bson.M, 0, len(achievements))
+    for _, a := range achievements {
+        unlocked, _ := a["unlocked"].(int64)
+        hidden, _ := a["hidden"].(bool)
+        if unlocked > 0 && !hidden {
+            visible = append(visible, a)
+        }
+    }
+    return visible
 }
 
-func NewSyncCoinCounts(hash string, count int) *SyncCoinCounts {
-    return &SyncCoinCounts{hash, count}
+// userAchievements joins the user's unlocked and in progress achievements
+// with the catalog
+func (ds *DBSession) userAchievements(hash string, game string) []bson.M {
+    unlocks := ds.DB(GUSTO_DB_NAME).C(USER_ACHIEVEMENTS)
+    selector := bson.M{"hash": hash}
+    if game != "" {
+        selector["game"] = game
+    }
+    
+    var records []datatypes.AchievementUnlock
+    var ids []string
+    iterate(unlocks.Find(selector), func(doc bson.M) {
+        record := datatypes.AchievementUnlock{Hash: hash}
+        record.Game, _ = doc["game"].(string)
+        record.Id, _ = doc["id"].(string)
+        record.Progress, _ = doc["progress"].(int)
+        record.Unlocked, _ = doc["unlocked"].(int64)
+        records = append(records, record)
+        ids = append(ids, record.Id)
+    })
+    
+    catalog := ds.achievementDefs(bson.M{"id": bson.M{"$in": ids}})
+    
+    achievements := make([]bson.M, 0, len(records))
+    for _, record := range records {
+        if record.Game == LEGACY_ACHIEVEMENT_GAME {
+            achievements = append(achievements, bson.M{"game": record.Game, "id": record.Id,
+                                                       "unlocked": record.Unlocked})
+            continue
+        }
+        if def, found := catalog[record.Game + "/" + record.Id]; found {
+            target := achievementTarget(&def)
+            progress := record.Progress
+            if record.Unlocked > 0 {
+                progress = target
+            }
+            achievements = append(achievements, bson.M{"game": def.Game, "id": def.Id,
+                                                       "title": def.Title,
+                                                       "description": def.Description,
+                                                       "points": def.Points,
+                                                       "progress": progress,
+                                                       "target": target,
+                                                       "percent": progress * 100 / target,
+                                                       "unlocked": record.Unlocked,
+                                                       "hidden": def.Hidden})
+        }
+    }
+    return achievements
 }
 
-func (req *SyncCoinCounts) Perform() datatypes.Response {
-    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+// achievementDefs loads the catalog entries matching the selector, keyed by
+// "<game>/<id>"
+func (ds *DBSession) achievementDefs(selector bson.M) map[string]datatypes.AchievementDef {
+    defs := make(map[string]datatypes.AchievementDef)
+    catalog := ds.DB(GUSTO_DB_NAME).C(ACHIEVEMENT_CATALOG)
+    iterate(catalog.Find(selector), func(doc bson.M) {
+        def := datatypes.AchievementDef{}
+        def.Game, _ = doc["game"].(string)
+        def.Id, _ = doc["id"].(string)
+        def.Title, _ = doc["title"].(string)
+        def.Description, _ = doc["description"].(string)
+        def.Points, _ = doc["points"].(int)
+        def.Hidden, _ = doc["hidden"].(bool)
+        def.Target, _ = doc["target"].(int)
+        def.Rule, _ = doc["rule"].(string)
+        def.Threshold, _ = doc["threshold"].(int)
+        defs[def.Game + "/" + def.Id] = def
+    })
+    return defs
+}
 
+//
+// { "verb": "setAchievement", "hash": <user-id>, "game": <game name>, "achievement": <achievement id> }
+// { "result": true, "answer": {"game": <game>, "id": <id>, "title": <title>, "points": <int>, "unlocked": <time>} }
+//
+// Achievements with a rule or a target above 1 cannot be set: they are earned
+// on the server, or advanced with incrementAchievement.
+func (req *SetAchievementRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+    
     ds := NewSession()
     defer ds.Close()
 
-    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
-    query := users.Find(bson.M{"hash": req.hash})
-    var user interface{}
+    if !ds.validUserHash(req.hash) {
+        return &datatypes.GenericResponse{jsonRes}
+    }
     
-    if query.One(&user) == nil {
-        // new coin count = borrowed + req.count
-        if data, ok := user.(bson.M); ok {
-            jsonRes = "{\"result\": false, \"answer\": \"Generic Error\"}"
-            borrowed := data["borrowed"].(int)
-            earned := borrowed + req.count
-            fmt.Printf("SyncCoinCounts: replacing %d with %d earned coins\n", data["earned"].(int), earned)            
-            change := mgo.Change{Update: bson.M{"$set": bson.M{"borrowed": 0, "earned": earned}}}
-            var doc interface{}
-            if users.Find(bson.M{"hash": req.hash}).Modify(change, &doc) == nil {
-                jsonRes = "{\"result\": true, \"newCount\": " + strconv.Itoa(earned) + ", \"answer\": \"\"}"
-            }
+    if req.game == LEGACY_ACHIEVEMENT_GAME {
+        def := datatypes.AchievementDef{Game: req.game, Id: req.achievement}
+        if _, ok := ds.unlockAchievement(req.hash, &def); !ok {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+        } else {
+            jsonRes = "{\"result\": true, \"answer\": \"set achievement succeeded\"}"
         }
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    def, found := ds.achievementDefs(bson.M{"game": req.game, "id": req.achievement})[req.game + "/" + req.achievement]
+    if !found {
+        jsonRes = "{\"result\": false, \"answer\": \"Unknown achievement\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    if def.Rule != "" {
+        // earned on the server only
+        jsonRes = "{\"result\": false, \"answer\": \"This achievement is unlocked by its rule\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    if achievementTarget(&def) > 1 {
+        // progress is tracked on the server
+        jsonRes = "{\"result\": false, \"answer\": \"This achievement is unlocked with incrementAchievement\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    unlocked, ok := ds.unlockAchievement(req.hash, &def)
+    switch {
+    case !ok:
+        jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+    case !unlocked:
+        jsonRes = "{\"result\": false, \"answer\": \"Achievement already unlocked\"}"
+    default:
+        jsonRes = jsonAnswer(bson.M{"game": def.Game, "id": def.Id, "title": def.Title,
+                                    "points": def.Points, "unlocked": time.Seconds()})
     }
     
     return &datatypes.GenericResponse{jsonRes}
 }
 
-type CoinsAsk struct {
-    datatypes.CoinsRequest
+// unlockAchievement records the unlock unless the user already has it
+func (ds *DBSession) unlockAchievement(hash string, def *datatypes.AchievementDef) (unlocked bool, ok bool) {
+    unlocks := ds.DB(GUSTO_DB_NAME).C(USER_ACHIEVEMENTS)
+    record := bson.M{"hash": hash, "game": def.Game, "id": def.Id}
+    n, err := unlocks.Find(bson.M{"hash": hash, "game": def.Game, "id": def.Id,
+                                  "unlocked": bson.M{"$gt": 0}}).Count()
+    if err != nil {
+        return false, false
+    }
+    if n > 0 {
+        return false, true
+    }
+    
+    // completes the progress of a partially achieved record, if any
+    change := bson.M{"$set": bson.M{"progress": achievementTarget(def), "unlocked": time.Seconds()}}
+    if unlocks.Upsert(record, change) != nil {
+        return false, false
+    }
+    ds.notifyUnlock(hash, def)
+    return true, true
+}
+
+// notifyUnlock tells the user about an unlocked achievement
+func (ds *DBSession) notifyUnlock(hash string, def *datatypes.AchievementDef) {
+    if def.Game == LEGACY_ACHIEVEMENT_GAME {
+        return
+    }
+    if user, ok := ds.caller(hash); ok {
+        ds.postSystemMessage("", user.Name, datatypes.MessageAchievement,
+                             "Achievement unlocked: " + def.Title,
+                             bson.M{"game": def.Game, "id": def.Id, "title": def.Title,
+                                    "points": def.Points})
+    }
+}
+
+func achievementTarget(def *datatypes.AchievementDef) int {
+    if def.Target > 1 {
+        return def.Target
+    }
+    return 1
+}
+
+///////
+// Achievement rules. Achievements declaring a rule in the catalog are
+// unlocked by the server itself, right after the request that makes the rule
+// hold, and the unlocks are returned with that request's response.
+
+// evaluateAchievementRules unlocks the achievements whose rule of the given
+// kind holds for value. Score rules only apply to the scores of their game.
+func (ds *DBSession) evaluateAchievementRules(hash string, rule string, game string, value int) []bson.M {
+    selector := bson.M{"rule": rule, "threshold": bson.M{"$lte": value}}
+    if rule == datatypes.RuleScore {
+        selector["game"] = game
+    }
+    
+    earned := make([]bson.M, 0)
+    for _, def := range ds.achievementDefs(selector) {
+        if unlocked, _ := ds.unlockAchievement(hash, &def); unlocked {
+            earned = append(earned, bson.M{"game": def.Game, "id": def.Id,
+                                           "title": def.Title, "points": def.Points})
+        }
+    }
+    return earned
+}
+
+// incrementUserCounter adds to one of the counters kept with the user and
+// returns its new value
+func (ds *DBSession) incrementUserCounter(hash string, counter string, amount int) int {
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    change := mgo.Change{Update: bson.M{"$inc": bson.M{counter: amount}}, ReturnNew: true}
+    
+    var result interface{}
+    if users.Find(bson.M{"hash": hash}).Modify(change, &result) == nil {
+        if data, ok := result.(bson.M); ok {
+            value, _ := data[counter].(int)
+            return value
+        }
+    }
+    return 0
+}
+
+// marshalList encodes a list for embedding in a response, never failing
+func marshalList(list []bson.M) string {
+    if data, err := json.Marshal(list); err == nil && list != nil {
+        return string(data)
+    }
+    return "[]"
+}
+
+//////
+type IncrementAchievementRequest struct {
+    hash string
+    game string
+    achievement string
+    amount int
+}
+
+func NewIncrementAchievementRequest(hash string, game string, achievement string, amount int) *IncrementAchievementRequest {
+    return &IncrementAchievementRequest{hash, game, achievement, amount}
+}
+
+//
+// { "verb": "incrementAchievement", "hash": <user-id>, "game": <game name>, "achievement": <achievement id>, "amount": <unsigned integer> }
+// { "result": true, "answer": {"progress": <int>, "target": <int>, "percent": <0-100>, "complete": <bool>,
+//                              "unlocked": <bool, true for the request unlocking it only>} }
+//
+func (req *IncrementAchievementRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+
+    if !ds.validUserHash(req.hash) {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    def, found := ds.achievementDefs(bson.M{"game": req.game, "id": req.achievement})[req.game + "/" + req.achievement]
+    if !found {
+        jsonRes = "{\"result\": false, \"answer\": \"Unknown achievement\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    if def.Rule != "" {
+        // earned on the server only
+        jsonRes = "{\"result\": false, \"answer\": \"This achievement is unlocked by its rule\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    progress, unlocked, ok := ds.advanceAchievement(req.hash, &def, req.amount)
+    if !ok {
+        jsonRes = "{\"result\": false, \"answer\": \"Unknown error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    target := achievementTarget(&def)
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"progress": progress, "target": target,
+                                                        "percent": progress * 100 / target,
+                                                        "complete": progress == target,
+                                                        "unlocked": unlocked})}
+}
+
+// advanceAchievement adds to the progress of an achievement and unlocks it
+// once the target is reached; unlocked is only true for the request that
+// did. Progress of unlocked achievements is frozen.
+func (ds *DBSession) advanceAchievement(hash string, def *datatypes.AchievementDef, amount int) (progress int, unlocked bool, ok bool) {
+    unlocks := ds.DB(GUSTO_DB_NAME).C(USER_ACHIEVEMENTS)
+    record := bson.M{"hash": hash, "game": def.Game, "id": def.Id}
+    target := achievementTarget(def)
+    
+    var current datatypes.AchievementUnlock
+    if unlocks.Find(record).One(&current) == nil && current.Unlocked > 0 {
+        return target, false, true
+    }
+    
+    var result interface{}
+    change := mgo.Change{Update: bson.M{"$inc": bson.M{"progress": amount}}, Upsert: true, ReturnNew: true}
+    if unlocks.Find(record).Modify(change, &result) != nil {
+        return 0, false, false
+    }
+    if data, found := result.(bson.M); found {
+        progress, _ = data["progress"].(int)
+    }
+    
+    if progress >= target {
+        progress = target
+        // only the request crossing the target records the unlock
+        err := unlocks.Update(bson.M{"hash": hash, "game": def.Game, "id": def.Id,
+                                     "unlocked": bson.M{"$in": []interface{}{0, nil}}},
+                              bson.M{"$set": bson.M{"progress": target, "unlocked": time.Seconds()}})
+        if err != nil && err != mgo.NotFound {
+            return progress, false, false
+        }
+        if err == nil {
+            unlocked = true
+            ds.notifyUnlock(hash, def)
+        }
+    }
+    return progress, unlocked, true
+}
+
+//
+// { "verb": "getAchievementCatalog", "hash": <user-id>, "game": <game name> }
+// { "result": true, "answer": [zero-or-more{"id": <id>, "title": <title>, "description": <text>, "points": <int>, "target": <int>}] }
+//
+func (req *GetAchievementCatalogRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+
+    if !ds.validUserHash(req.hash) {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    // hidden achievements stay secret until they are unlocked
+    catalog := ds.achievementDefs(bson.M{"game": req.game, "hidden": bson.M{"$ne": true}})
+    defs := make([]bson.M, 0, len(catalog))
+    for _, def := range catalog {
+        defs = append(defs, bson.M{"id": def.Id, "title": def.Title,
+                                   "description": def.Description, "points": def.Points,
+                                   "target": achievementTarget(&def)})
+    }
+    
+    return &datatypes.GenericResponse{jsonAnswer(defs)}
+}
+
+// DefineAchievement adds an achievement to the catalog, or updates it
+func (ds *DBSession) DefineAchievement(def *datatypes.AchievementDef) bool {
+    catalog := ds.DB(GUSTO_DB_NAME).C(ACHIEVEMENT_CATALOG)
+    err := catalog.Upsert(bson.M{"game": def.Game, "id": def.Id}, def)
+    return err == nil
+}
+
+/////
+type GetCoinCountRequest struct {
+    name string
+}
+
+func NewGetCoinCount(name string) *GetCoinCountRequest {
+    return &GetCoinCountRequest{name}
+}
+
+func (req *GetCoinCountRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.lookupUser(req.name)
+    if !ok {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    // coin count = borrowed + earned
+    count := user.Borrowed + user.Earned
+    jsonRes = "{\"result\": true, \"answer\": " + strconv.Itoa(count) + "}"
+    
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+//////
+type GetPendingCoinRequest struct {
+    hash string
+    limit int
+}
+
+func NewGetPendingCoinRequests(hash string, limit int) *GetPendingCoinRequest {
+    return &GetPendingCoinRequest{hash, limit}
+}
+
+//
+// { "verb": "getPendingCoinRequests", "hash": <user-id>, "limit": <unsigned integer> }
+// { "result": true, "answer" : [zero-or-more{"name": <name>, "count": <unsigned int>}] }
+//
+func (req *GetPendingCoinRequest) Perform() datatypes.Response {
+    //jsonRes := "{\"result\": false, \"answer\": []"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+
+    if !ds.validUserHash(req.hash) {
+        jsonRes := "{\"result\": false, \"answer\": []}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    coinRequests := ds.DB(GUSTO_DB_NAME).C(PENDING_COIN_REQUESTS);
+    requestsForDonor := coinRequests.Find(bson.M{"donorhash": req.hash})
+    //query := requests.Find(bson.M{"donorhash": req.hash}).
+    query := requestsForDonor.
+                         Select(bson.M{"_id": 0, "requester": 1, "ask" : 1})
+    count, err := query.Count()
+    if err == nil && count == 0 {
+        jsonRes := "{\"result\": true, \"answer\": []}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    fmt.Printf("GetPendingCoinRequests: %d\n", count)
+    
+    mapRes := "[ "
+    if iter, err := query.Iter(); err == nil {
+        var result interface{}
+        firstItem := true
+        
+        for {
+            result = nil
+            if err = iter.Next(&result); err != nil {
+                break
+            }
+            if data, err := json.Marshal(result); err == nil {
+                if !firstItem { mapRes += ", " }
+                mapRes += string(data)
+                firstItem = false
+            }
+        }
+        // DO NOT DO THE FOLLOWING, STUPID!! 
+        // remove the requests from the collection
+        coinRequests.RemoveAll(bson.M{"donorhash": req.hash})
+    }
+    mapRes += " ]"
+    
+    jsonRes := "{\"result\": true, \"answer\":" + mapRes + "}"
+    
+    fmt.Printf("    %s\n", jsonRes)
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+///////
+type SyncCoinCounts struct {
+    hash string
+    count int
+}
+
+func NewSyncCoinCounts(hash string, count int) *SyncCoinCounts {
+    return &SyncCoinCounts{hash, count}
+}
+
+func (req *SyncCoinCounts) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS);
+    query := users.Find(bson.M{"hash": req.hash})
+    var user interface{}
+    
+    if query.One(&user) == nil {
+        // new coin count = borrowed + req.count
+        if data, ok := user.(bson.M); ok {
+            jsonRes = "{\"result\": false, \"answer\": \"Generic Error\"}"
+            borrowed := data["borrowed"].(int)
+            earned := borrowed + req.count
+            fmt.Printf("SyncCoinCounts: replacing %d with %d earned coins\n", data["earned"].(int), earned)            
+            change := mgo.Change{Update: bson.M{"$set": bson.M{"borrowed": 0, "earned": earned}}}
+            var doc interface{}
+            if users.Find(bson.M{"hash": req.hash}).Modify(change, &doc) == nil {
+                jsonRes = "{\"result\": true, \"newCount\": " + strconv.Itoa(earned) + ", \"answer\": \"\"}"
+            }
+        }
+    }
+    
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+type CoinsAsk struct {
+    datatypes.CoinsRequest
 }
 
 func NewCoinsRequest(requester /* hash */string, donor string, ask int) *CoinsAsk {
@@ -447,13 +1176,15 @@ func (req *CoinsAsk) Perform() datatypes.Response {
 
     fmt.Printf("Coin Reqester(Hash): %v, donor: %s\n", req.RequesterHash, req.Donor)
     
-    if !(dataStore.validUser(req.Donor) && dataStore.validUserHash(req.RequesterHash)) {
+    requester, r1 := dataStore.caller(req.RequesterHash)
+    donor, r2 := dataStore.lookupUser(req.Donor)
+    if !(r1 && r2) {
         jsonRes = "{\"result\": false, \"answer\": \"Not a registered requester or recipient in the request\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
     
-    req.Requester = dataStore.UserNameFromHash(req.RequesterHash)
-    req.DonorHash = dataStore.HashFromUserName(req.Donor)
+    req.Requester = requester.Name
+    req.Donor, req.DonorHash = donor.Name, donor.Hash
     
     c := dataStore.DB(GUSTO_DB_NAME).C(PENDING_COIN_REQUESTS);
     query := c.Find(bson.M{"requesterhash": req.RequesterHash, "donor": req.Donor})
@@ -462,6 +1193,12 @@ func (req *CoinsAsk) Perform() datatypes.Response {
     /* TODO: instead of inserting, should we consider updating the count? */
         if e := c.Insert(req.CoinsRequest); e == nil {
             fmt.Printf("Coin Request sent successfully\n")
+            // like their other messages, those of shadow banned users go nowhere
+            if requester.Status != datatypes.AccountShadow {
+                dataStore.postSystemMessage(req.Requester, req.Donor, datatypes.MessageCoinRequest,
+                                            req.Requester + " asked you for " + strconv.Itoa(req.Ask) + " coins",
+                                            bson.M{"from": req.Requester, "count": req.Ask})
+            }
             jsonRes = "{\"result\": true, \"answer\": \"coin request sent successfully\"}"
         } else {
             fmt.Printf("attempt to insert coin request failed!")
@@ -507,13 +1244,16 @@ func (req *CoinsOffer) Perform() datatypes.Response {
     ds := NewSession()
     defer ds.Close()
 
-    if !(ds.validUserHash(req.DonorHash) && ds.validUser(req.Requester)) {
+    donor, r1 := ds.caller(req.DonorHash)
+    requester, r2 := ds.lookupUser(req.Requester)
+    if !(r1 && r2) {
         jsonRes := "{\"result\": false, \"answer\": \"Unknown users specified in the request\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
 
-    donorName := ds.UserNameFromHash(req.DonorHash)
-    requesterHash := ds.HashFromUserName(req.Requester)
+    donorName := donor.Name
+    req.Requester = requester.Name
+    requesterHash := requester.Hash
     
     // first sync the "earned" coin count with that on the device
     var result interface{} = nil
@@ -544,91 +1284,107 @@ func (req *CoinsOffer) Perform() datatypes.Response {
         err = users.Find(bson.M{"name": donorName, "hash": req.DonorHash}).Modify(debit, &result)
        
         if err == nil {
-            jsonRes = fmt.Sprintf("{\"result\": true, \"offered\": %d, \"newCount\": %d, \"answer\": \"\" }", req.Offer, updatedEarned)
+            if donor.Status != datatypes.AccountShadow {
+                ds.postSystemMessage(donorName, req.Requester, datatypes.MessageCoinGift,
+                                     donorName + " gave you " + strconv.Itoa(req.Offer) + " coins",
+                                     bson.M{"from": donorName, "count": req.Offer})
+            }
+            donated := ds.incrementUserCounter(req.DonorHash, "donated", req.Offer)
+            unlocked := ds.evaluateAchievementRules(req.DonorHash, datatypes.RuleCoinsDonated, "", donated)
+            jsonRes = fmt.Sprintf("{\"result\": true, \"offered\": %d, \"newCount\": %d, \"answer\": \"\", \"unlocked\": %s }", req.Offer, updatedEarned, marshalList(unlocked))
         }
     }
     
     return &datatypes.GenericResponse{jsonRes}
 }
 
-func (ds *DBSession) validUser(name string) bool {
-    res := false
+///////
+// Identity resolution. The hash issued at registration is the caller's
+// credential, so the caller of a request is only ever identified by it.
+// Other players can be referred to by any of their identities: the hash, the
+// name or the id of their external profile.
+
+func (ds *DBSession) findUser(selector bson.M) (*datatypes.User, bool) {
+    var user datatypes.User
     c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
-    query := c.Find(bson.M{"name":name})
-    if n, e := query.Count(); e == nil && n == 1 { 
-        res = true 
-    } else {
-        fmt.Printf("Invalid User request : %s\n", name)
+    if c.Find(selector).One(&user) != nil {
+        return nil, false
     }
-    return res
+    return &user, true
 }
 
-func (ds *DBSession) validUserHash(hash string) bool {
-    res := false
-    c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
-    query := c.Find(bson.M{"hash": hash})
-    if n, e := query.Count(); e == nil && n == 1 { 
-        res = true 
-    } else {
-        fmt.Printf("Invalid user hash in JSON request: %v", hash)
+// caller resolves the user issuing a request
+func (ds *DBSession) caller(hash string) (*datatypes.User, bool) {
+    if len(hash) == 0 {
+        return nil, false
     }
-    
-    return res
+    return ds.findUser(bson.M{"hash": hash})
 }
 
-func (ds *DBSession) HashFromUserName(name string) (hash string) {
-    var record interface{}
-    hash = ""
+// lookupUser resolves a user from any of its identities, preferring the hash
+// over the name over the profile id when they refer to different users.
+func (ds *DBSession) lookupUser(id string) (*datatypes.User, bool) {
+    if len(id) == 0 {
+        return nil, false
+    }
     
     c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
-    query := c.Find(bson.M{"name": name})
-    if n, e := query.Count(); e == nil && n == 1 { 
-        err := query.Select(bson.M{"hash": 1, "_id": 0}).Distinct("hash", &record)
-        if err == nil {
-            if r, ok := record.([]interface{}); ok {
-	            if data, e := json.Marshal(r[0]); e == nil && len(data) > 2 {
-	                hash = string(data[1:len(data)-1])
-	                fmt.Printf("HashFromUserName: %s --> %s\n", hash, name)
-	            }
-	        }
-        }
-    } else {
-        fmt.Printf("Invalid user hash in JSON request: %v", hash)
+    query := c.Find(bson.M{"$or": []bson.M{{"hash": id}, {"name": id}, {"profileid": id}}})
+    iter, err := query.Iter()
+    if iter == nil || err != nil {
+        return nil, false
     }
     
-    return hash
-}
-
-
-func (ds *DBSession) UserNameFromHash(hash string) (name string) {
-    var record interface{}
-    name = ""
-    
-    c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
-    query := c.Find(bson.M{"hash": hash})
-    if n, e := query.Count(); e == nil && n == 1 {
-        err := query.Select(bson.M{"name": 1, "_id": 0}).Distinct("name", &record)
-        if err == nil {
-            if r, ok := record.([]interface{}); ok {
-	            if data, e := json.Marshal(r[0]); e == nil && len(data) > 2 {
-	                name = string(data[1:len(data)-1])
-	                fmt.Printf("UserNameFromHash: %s --> %s\n", hash, name)
-	            } else {
-	                fmt.Printf("UserNameFromHash[Failed 3]: %d, %v\n", n, e)
-	            }
-	        }
-        } else {
-            fmt.Printf("UserNameFromHash[Failed 2]: %d, %v\n", n, err)
+    var found *datatypes.User
+    rank := 0
+    for {
+        var user datatypes.User
+        if iter.Next(&user) != nil {
+            break
+        }
+        r := 1
+        switch id {
+        case user.Hash: r = 3
+        case user.Name: r = 2
+        }
+        if r > rank {
+            u := user
+            found, rank = &u, r
         }
-    } else {
-        fmt.Printf("UserNameFromHash[Failed 1]: %d, %v\n", n, e)
     }
-    
-    if name == "" {
-        fmt.Printf("UserNameFromHash Error: user with provided hash doesn't exist. %s\n", hash)
+    return found, found != nil
+}
+
+func (ds *DBSession) validUser(id string) bool {
+    _, res := ds.lookupUser(id)
+    if !res {
+        fmt.Printf("Invalid User request : %s\n", id)
     }
-    
-    return name
+    return res
+}
+
+func (ds *DBSession) validUserHash(hash string) bool {
+    _, res := ds.caller(hash)
+    if !res {
+        fmt.Printf("Invalid user hash in JSON request: %v", hash)
+    }
+    return res
+}
+
+func (ds *DBSession) HashFromUserName(name string) (hash string) {
+    if user, ok := ds.lookupUser(name); ok {
+        return user.Hash
+    }
+    fmt.Printf("HashFromUserName Error: user doesn't exist. %s\n", name)
+    return ""
+}
+
+func (ds *DBSession) UserNameFromHash(hash string) (name string) {
+    if user, ok := ds.caller(hash); ok {
+        return user.Name
+    }
+    fmt.Printf("UserNameFromHash Error: user with provided hash doesn't exist. %s\n", hash)
+    return ""
 }
 
 /////////
@@ -637,170 +1393,3244 @@ type sendMessage struct {
     //datatypes.ShortTextMessage
     from string
     to string
+    conversation string /* instead of "to", for group conversations */
     text   string
 }
 
 type receiveMessage struct {
     to string
     limit int
+    wait int64 /* seconds to wait for a message when the inbox is empty */
+}
+
+type ackMessages struct {
+    to string
+    ids []string
 }
 
 func NewSendMessage(from string, to string, msg string) *sendMessage {
     //return &SendMessage{datatypes.ShortMessage{from, to, msg}}
-    return &sendMessage{from, to, msg}
+    return &sendMessage{from, to, "", msg}
+}
+
+func NewSendConversationMessage(from string, conversation string, msg string) *sendMessage {
+    return &sendMessage{from, "", conversation, msg}
+}
+
+func NewReceiveMessage(to string, limit int, wait int) *receiveMessage {
+    return &receiveMessage{to, limit, int64(wait)}
 }
 
-func NewReceiveMessage(to string, limit int) *receiveMessage {
-    return &receiveMessage{to, limit}
+func NewAckMessages(to string, ids []string) *ackMessages {
+    return &ackMessages{to, ids}
 }
 
+// Inboxes only keep the most recent messages, and none older than a month
+const MAX_INBOX_MESSAGES = 200
+const MESSAGE_RETENTION_SECONDS = 30 * 24 * 60 * 60
+
+//
+// { "verb": "sendMessage", "from": <user-id>, "to": <name or profile id>, "message": <text> }
+// { "verb": "sendMessage", "from": <user-id>, "conversation": <conversation id>, "message": <text> }
+// { "result": true, "answer": "message sent", "conversation": <conversation id>, "unlocked": [zero-or-more{...}] }
+//
+// A message is recorded in the history of its conversation, the 1:1
+// conversation of sender and receiver when sent "to" somebody, and delivered
+// to the inbox of every other member who has not blocked the sender.
 func (req *sendMessage) Perform() datatypes.Response {
     ds := NewSession()
     defer ds.Close()
 
-    jsonRes := "{\"result\": false, \"answer\": \"\"}"
-    if (!ds.validUserHash(req.from) || !ds.validUser(req.to) || req.from == req.to) {
-        jsonRes = "{\"result\": false, \"answer\": \"Invalid user specified in sendMessage request\"}"
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in sendMessage request\"}"
+    sender, ok := ds.caller(req.from)
+    if (!ok) {
         return &datatypes.GenericResponse{jsonRes}
     }
 
-    messages := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
-    senderName := ds.UserNameFromHash(req.from)
-    if messages.Insert(bson.M{"from": senderName, "to": req.to, "msg": req.text}) == nil {
-        jsonRes = "{\"result\": true, \"answer\": \"message sent\"}"
+    var conv *datatypes.Conversation
+    if req.conversation != "" {
+        if conv, ok = ds.conversation(req.conversation); !ok || !isMember(conv, sender.Name) {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown conversation specified in sendMessage request\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
     } else {
+        receiver, found := ds.lookupUser(req.to)
+        if (!found || sender.Hash == receiver.Hash) {
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        if ds.blocked(receiver.Name, sender.Name) {
+            jsonRes = "{\"result\": false, \"answer\": \"message not delivered\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        if sender.Status == datatypes.AccountShadow {
+            // not even the conversation may show up on the receiver's side
+            conv = &datatypes.Conversation{ConvId: directConversationId(sender.Name, receiver.Name)}
+        } else if conv, ok = ds.directConversation(sender.Name, receiver.Name); !ok {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown error while attempting to send the message\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+    }
+
+    // the messages of shadow banned users go nowhere, unbeknownst to them
+    if sender.Status == datatypes.AccountShadow {
+        jsonRes = "{\"result\": true, \"answer\": \"message sent\", \"conversation\": \"" + conv.ConvId + "\", \"unlocked\": []}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    message := datatypes.ShortTextMessage{newToken(), sender.Name, "", req.text, time.Seconds(), conv.ConvId,
+                                          datatypes.MessageText, nil}
+    if !ds.recordConversationMessage(conv, &message) {
         jsonRes = "{\"result\": false, \"answer\": \"Unknown error while attempting to send the message\"}"
+        return &datatypes.GenericResponse{jsonRes}
     }
+    for _, member := range conv.Members {
+        if member != sender.Name && !ds.blocked(member, sender.Name) {
+            ds.deliver(member, message)
+        }
+    }
+
+    sent := ds.incrementUserCounter(req.from, "messagessent", 1)
+    unlocked := ds.evaluateAchievementRules(req.from, datatypes.RuleMessagesSent, "", sent)
+    jsonRes = "{\"result\": true, \"answer\": \"message sent\", \"conversation\": \"" + conv.ConvId +
+              "\", \"unlocked\": " + marshalList(unlocked) + "}"
     return &datatypes.GenericResponse{jsonRes}
 }
 
+// postSystemMessage sends a typed message from Marvin itself, about what
+// another player, the actor, did. The text is a readable summary for clients
+// that do not render the payload. Receivers who blocked the actor hear
+// nothing; events without an actor have an empty one.
+const SYSTEM_SENDER = "marvin"
+
+// ReservedName tells whether a user or display name would pass for the
+// system sender
+func ReservedName(name string) bool {
+    return DisplayKey(name) == SYSTEM_SENDER
+}
+
+func (ds *DBSession) postSystemMessage(actor string, to string, kind string, text string, payload bson.M) bool {
+    if actor != "" && ds.blocked(to, actor) {
+        return false
+    }
+    message := datatypes.ShortTextMessage{newToken(), SYSTEM_SENDER, to, text, time.Seconds(), "",
+                                          kind, payload}
+    return ds.deliver(to, message)
+}
+
+// deliver puts a copy of the message into the receiver's inbox
+func (ds *DBSession) deliver(receiver string, message datatypes.ShortTextMessage) bool {
+    messages := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
+    message.To = receiver
+    ds.pruneInbox(receiver)
+    if messages.Insert(&message) != nil {
+        return false
+    }
+    publish(receiver, bson.M{"event": "message", "id": message.MsgId, "from": message.From,
+                             "conversation": message.Conversation, "type": message.Type})
+    hub.Publish(inboxKey(receiver), "")
+    return true
+}
+
+// inboxKey is the hub key waking up the receiveMessage requests waiting on
+// an inbox, which only care about new messages
+func inboxKey(receiver string) string {
+    return receiver + "/inbox"
+}
+
+//
+// { "verb": "receiveMessage", "receiver": <user-id>, "limit": <unsigned integer>, "wait": <seconds, optional> }
+// { "result": true, "answer": [zero-or-more{"id": <message id>, "from": <name>, "msg": <text>, "sent": <time>, "type": "text",
+//                                           "conversation": <conversation id>}],
+//   "dropped": <messages pruned from the full inbox since the last receiveMessage> }
+//
+// System messages have one of the other datatypes.Message* types, come from
+// "marvin" and carry a "payload" object describing the event instead of
+// belonging to a conversation.
+//
+// Messages are returned oldest first and stay in the inbox until they are
+// acknowledged with ackMessages. With "wait", a request finding the inbox
+// empty is held until a message arrives or the wait is over.
 func (req *receiveMessage) Perform() datatypes.Response {
     jsonRes := "{\"result\": false}"
 
     ds := NewSession()
-    defer ds.Close()
+    defer func() { ds.Close() }()
 
-    if (!ds.validUserHash(req.to)) {
+    user, ok := ds.caller(req.to)
+    if (!ok) {
         jsonRes = "{\"result\": false, \"answer\": \"Invalid user specified in receiveMessage request\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
 
+    var notifications chan string
+    if req.wait > 0 {
+        // subscribe before looking, not to miss a message sent in between
+        notifications = hub.Subscribe(inboxKey(user.Name))
+        defer hub.Unsubscribe(inboxKey(user.Name), notifications)
+    }
+
+    messages := ds.inbox(user.Name, req.limit)
+    if len(messages) == 0 && notifications != nil {
+        // the datastore session is given back for the wait
+        ds.Close()
+        select {
+        case <-notifications:
+        case <-time.After(req.wait * 1e9):
+        }
+        ds = NewSession()
+        messages = ds.inbox(user.Name, req.limit)
+    }
+
+    dropped := ds.takeDroppedCount(user.Name)
+    jsonRes = "{\"result\": true, \"answer\":" + marshalList(messages) + ", \"dropped\": " + strconv.Itoa(dropped) + "}"
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+func (ds *DBSession) inbox(receiver string, limit int) []bson.M {
     messageCollection := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
-    receiver := ds.UserNameFromHash(req.to)
     // The "_id" field is included by default. We must exclude it specifically.
-    query := messageCollection.Find(bson.M{"to" : receiver}).
-                               Select(bson.M{"from": 1, "msg": 1,"_id": 0})
-    if c, err := query.Count(); err != nil || c == 0 {
-        jsonRes = "{\"result\": true, \"answer\": []}"
+    query := messageCollection.Find(bson.M{"to" : receiver}).Sort(bson.M{"sent": 1}).Limit(limit).
+                               Select(bson.M{"msgid": 1, "from": 1, "msg": 1, "sent": 1, "conversation": 1,
+                                             "type": 1, "payload": 1, "_id": 0})
+
+    messages := make([]bson.M, 0, limit)
+    iterate(query, func(doc bson.M) {
+        kind, _ := doc["type"].(string)
+        if kind == "" {
+            kind = datatypes.MessageText
+        }
+        message := bson.M{"id": doc["msgid"], "from": doc["from"], "msg": doc["msg"],
+                          "sent": doc["sent"], "type": kind}
+        if kind == datatypes.MessageText {
+            message["conversation"] = doc["conversation"]
+        } else {
+            message["payload"] = doc["payload"]
+        }
+        messages = append(messages, message)
+    })
+    return messages
+}
+
+//
+// { "verb": "ackMessages", "receiver": <user-id>, "ids": [one-or-more <message id>] }
+// { "result": true, "answer": "" }
+//
+func (req *ackMessages) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in ackMessages request\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.to)
+    if (!ok) {
         return &datatypes.GenericResponse{jsonRes}
     }
 
-    mapRes := "[ "
-    if iter, err := query.Iter(); err == nil {
-        var result interface{}
-        firstItem := true
-        
-        for {
-            result = nil
-            if err = iter.Next(&result); err != nil {
-                break
-            }
-            if data, err := json.Marshal(result); err == nil {
-                if !firstItem { mapRes += ", " }
-                mapRes += string(data)
-                firstItem = false
+    // only the receiver's own messages can be acknowledged
+    messages := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
+    if messages.RemoveAll(bson.M{"to": user.Name, "msgid": bson.M{"$in": req.ids}}) == nil {
+        jsonRes = "{\"result\": true, \"answer\": \"\"}"
+    } else {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+    }
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+// pruneInbox enforces the retention limits on an inbox before a message is
+// added to it: expired messages go, and so do the oldest ones of a full
+// inbox. Messages stay in the inbox until acknowledged, so whatever is pruned
+// was never acknowledged: the receiver is told how many messages were
+// dropped with their next receiveMessage.
+func (ds *DBSession) pruneInbox(receiver string) {
+    messages := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
+    expired := bson.M{"to": receiver, "sent": bson.M{"$lt": time.Seconds() - MESSAGE_RETENTION_SECONDS}}
+    dropped, err := messages.Find(expired).Count()
+    if err == nil && dropped > 0 {
+        messages.RemoveAll(expired)
+    }
+
+    // room for the message to come: exactly the overflow goes, picked by id
+    // since many messages may share a second
+    if count, err := messages.Find(bson.M{"to": receiver}).Count(); err == nil && count >= MAX_INBOX_MESSAGES {
+        var ids []string
+        query := messages.Find(bson.M{"to": receiver}).Sort(bson.M{"sent": 1}).
+                          Limit(count - MAX_INBOX_MESSAGES + 1).Select(bson.M{"msgid": 1, "_id": 0})
+        iterate(query, func(doc bson.M) {
+            if id, ok := doc["msgid"].(string); ok {
+                ids = append(ids, id)
             }
+        })
+        if len(ids) > 0 && messages.RemoveAll(bson.M{"to": receiver, "msgid": bson.M{"$in": ids}}) == nil {
+            dropped += len(ids)
         }
-        
-        // remove the messages from the collection
-        messageCollection.RemoveAll(bson.M{"to": receiver})
     }
-    mapRes += " ]"
-    
-    jsonRes = "{\"result\": true, \"answer\":" + mapRes + "}"
+
+    if dropped > 0 {
+        ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS).Update(bson.M{"name": receiver},
+                                                         bson.M{"$inc": bson.M{"droppedmessages": dropped}})
+    }
+}
+
+// takeDroppedCount returns, and resets, the number of messages pruned from
+// the receiver's inbox unread.
+func (ds *DBSession) takeDroppedCount(receiver string) int {
+    var previous interface{}
+    change := mgo.Change{Update: bson.M{"$set": bson.M{"droppedmessages": 0}}}
+    if ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS).Find(bson.M{"name": receiver, "droppedmessages": bson.M{"$gt": 0}}).
+                            Modify(change, &previous) != nil {
+        return 0
+    }
+    data, _ := previous.(bson.M)
+    dropped, _ := data["droppedmessages"].(int)
+    return dropped
+}
+
+///////
+// Conversations. Every message belongs to a conversation whose history is
+// kept apart from the inboxes, so reading and acknowledging the inbox does
+// not lose it. 1:1 conversations are created by the first message between
+// two users; groups are created explicitly.
+
+const MAX_GROUP_MEMBERS = 10
+const MAX_CONVERSATIONS_LISTED = 50
+
+func (ds *DBSession) conversation(id string) (*datatypes.Conversation, bool) {
+    var conv datatypes.Conversation
+    conversations := ds.DB(GUSTO_DB_NAME).C(CONVERSATIONS)
+    if conversations.Find(bson.M{"convid": id}).One(&conv) != nil {
+        return nil, false
+    }
+    return &conv, true
+}
+
+func isMember(conv *datatypes.Conversation, name string) bool {
+    for _, member := range conv.Members {
+        if member == name {
+            return true
+        }
+    }
+    return false
+}
+
+// directConversation returns the 1:1 conversation of two users, creating
+// it on first use. Its id only depends on the pair of names.
+func (ds *DBSession) directConversation(a string, b string) (*datatypes.Conversation, bool) {
+    if b < a {
+        a, b = b, a
+    }
+    id := directConversationId(a, b)
+
+    if conv, found := ds.conversation(id); found {
+        return conv, true
+    }
+    now := time.Seconds()
+    conv := &datatypes.Conversation{id, []string{a, b}, false, "", now, now, "", ""}
+    conversations := ds.DB(GUSTO_DB_NAME).C(CONVERSATIONS)
+    if conversations.Upsert(bson.M{"convid": id}, conv) != nil {
+        return nil, false
+    }
+    return conv, true
+}
+
+func directConversationId(a string, b string) string {
+    if b < a {
+        a, b = b, a
+    }
+    hasher := sha1.New()
+    hasher.Write([]byte(a + "\x00" + b))
+    return hex.EncodeToString(hasher.Sum())
+}
+
+func (ds *DBSession) recordConversationMessage(conv *datatypes.Conversation, message *datatypes.ShortTextMessage) bool {
+    history := ds.DB(GUSTO_DB_NAME).C(CONVERSATION_MESSAGES)
+    if history.Insert(message) != nil {
+        return false
+    }
+    conversations := ds.DB(GUSTO_DB_NAME).C(CONVERSATIONS)
+    conversations.Update(bson.M{"convid": conv.ConvId},
+                         bson.M{"$set": bson.M{"updated": message.Sent, "lastfrom": message.From,
+                                               "lastmsg": message.Msg}})
+    // the sender has obviously read the conversation
+    ds.markConversationRead(conv.ConvId, message.From, message.Sent)
+    return true
+}
+
+func (ds *DBSession) markConversationRead(id string, member string, at int64) {
+    reads := ds.DB(GUSTO_DB_NAME).C(CONVERSATION_READS)
+    reads.Upsert(bson.M{"convid": id, "member": member},
+                 bson.M{"convid": id, "member": member, "read": at})
+}
+
+type createConversation struct {
+    hash string
+    members []string
+    title string
+}
+
+func NewCreateConversation(hash string, members []string, title string) *createConversation {
+    return &createConversation{hash, members, title}
+}
+
+//
+// { "verb": "createConversation", "hash": <user-id>, "members": [one-or-more <name or profile id>], "title": <text> }
+// { "result": true, "answer": <conversation id> }
+//
+func (req *createConversation) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    conv := &datatypes.Conversation{newToken(), []string{user.Name}, true, req.title,
+                                    time.Seconds(), time.Seconds(), "", ""}
+    for _, id := range req.members {
+        member, found := ds.lookupUser(id)
+        if !found {
+            jsonRes = "{\"result\": false, \"answer\": \"Unknown member specified in createConversation request\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        if !isMember(conv, member.Name) {
+            conv.Members = append(conv.Members, member.Name)
+        }
+    }
+    if len(conv.Members) < 2 || len(conv.Members) > MAX_GROUP_MEMBERS {
+        jsonRes = "{\"result\": false, \"answer\": \"Invalid number of members in createConversation request\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+    conversations := ds.DB(GUSTO_DB_NAME).C(CONVERSATIONS)
+    if conversations.Insert(conv) == nil {
+        jsonRes = "{\"result\": true, \"answer\": \"" + conv.ConvId + "\"}"
+    }
     return &datatypes.GenericResponse{jsonRes}
 }
 
-type leaderBoardRequest struct {
+type listConversations struct {
     hash string
 }
 
-func NewLeaderBoardRequest(hash string) *leaderBoardRequest {
-    return &leaderBoardRequest{hash}
+func NewListConversations(hash string) *listConversations {
+    return &listConversations{hash}
 }
 
-func (req *leaderBoardRequest) Perform() datatypes.Response {
+//
+// { "verb": "listConversations", "hash": <user-id> }
+// { "result": true, "answer": [zero-or-more{"id": <conversation id>, "members": [<name>...], "group": <bool>, "title": <text>,
+//                                           "last": {"from": <name>, "msg": <text>, "sent": <time>}, "unread": <int>}] }
+//
+// Most recently active conversations first.
+func (req *listConversations) Perform() datatypes.Response {
     ds := NewSession()
     defer ds.Close()
 
-    if (!ds.validUserHash(req.hash)) {
-        jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in getLeaderBoard request\"}"
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
 
-    gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
-    
-    var games []string
-    if err := gameScores.Find(nil).Distinct("game", &games); err != nil {
-        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+    var convs []datatypes.Conversation
+    var ids []string
+    conversations := ds.DB(GUSTO_DB_NAME).C(CONVERSATIONS)
+    query := conversations.Find(bson.M{"members": user.Name}).Sort(bson.M{"updated": -1}).
+                           Limit(MAX_CONVERSATIONS_LISTED)
+    if iter, err := query.Iter(); iter != nil && err == nil {
+        for {
+            var conv datatypes.Conversation
+            if iter.Next(&conv) != nil {
+                break
+            }
+            convs = append(convs, conv)
+            ids = append(ids, conv.ConvId)
+        }
+    }
+
+    read := make(map[string]int64, len(ids))
+    reads := ds.DB(GUSTO_DB_NAME).C(CONVERSATION_READS)
+    iterate(reads.Find(bson.M{"member": user.Name, "convid": bson.M{"$in": ids}}), func(doc bson.M) {
+        if id, ok := doc["convid"].(string); ok {
+            read[id], _ = doc["read"].(int64)
+        }
+    })
+
+    history := ds.DB(GUSTO_DB_NAME).C(CONVERSATION_MESSAGES)
+    answer := make([]bson.M, 0, len(convs))
+    for _, conv := range convs {
+        unread, _ := history.Find(bson.M{"conversation": conv.ConvId, "sent": bson.M{"$gt": read[conv.ConvId]},
+                                         "from": bson.M{"$ne": user.Name}}).Count()
+        entry := bson.M{"id": conv.ConvId, "members": conv.Members, "group": conv.Group,
+                        "title": conv.Title, "unread": unread}
+        if conv.LastFrom != "" {
+            entry["last"] = bson.M{"from": conv.LastFrom, "msg": conv.LastMsg, "sent": conv.Updated}
+        }
+        answer = append(answer, entry)
+    }
+    return &datatypes.GenericResponse{jsonAnswer(answer)}
+}
+
+type getConversation struct {
+    hash string
+    conversation string
+    before int64 /* 0 for the latest messages */
+    cursor string /* "" for the latest messages */
+    limit int
+}
+
+func NewGetConversation(hash string, conversation string, before int, cursor string, limit int) *getConversation {
+    return &getConversation{hash, conversation, int64(before), cursor, limit}
+}
+
+//
+// { "verb": "getConversation", "hash": <user-id>, "conversation": <conversation id>, "cursor": <cursor, optional>,
+//   "before": <time, optional>, "limit": <unsigned integer> }
+// { "result": true, "answer": [zero-or-more{"id": <message id>, "from": <name>, "msg": <text>, "sent": <time>}],
+//   "cursor": <cursor of the next page, "" after the last one> }
+//
+// Messages are returned newest first; pages further back in the history are
+// fetched with the "cursor" of the previous page. "before", the time of the
+// oldest message received so far, is still understood, but skips the other
+// messages sent that second. Fetching the latest messages marks the
+// conversation read.
+func (req *getConversation) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    user, r1 := ds.caller(req.hash)
+    conv, r2 := ds.conversation(req.conversation)
+    if !r1 || !r2 || !isMember(conv, user.Name) {
+        jsonRes := "{\"result\": false, \"answer\": \"Unknown conversation specified in getConversation request\"}"
         return &datatypes.GenericResponse{jsonRes}
     }
-    
-    mainResultStr := "true"
-    mainAnswerStr := "[ "
-    firstGameRecord := true
-    strGamePlayerScore := ""
-    //
-    // {result: true, answer: [{"game": "Boondh", scores: [{"player": "siddu", "score": 80}, {"player": "shamanth", "score": 300}, ..., ] }, {"game": "Three Monkeys", "scores": [{}, {}, {}] }]
-    
-    for i := 0; i < len(games); i++ {
-        //fmt.Printf("collecting top 5 scorers for [%s]\n", games[i])
-        
-        queryTopFiveScores := gameScores.Find(bson.M{"game": games[i]}).
-                                      Sort(bson.M{"score": -1}).Limit(5).
-                                          Select(bson.M{"hash": 1, "score": 1, "_id": 0})
-        
-        mapPlayerScore := "[ "
-        strPlayerScoreRecord := ""
-        
-        if iter, err := queryTopFiveScores.Iter(); iter != nil && err == nil {
-            var result interface{}
-            firsPlayerScoreRecord := true
-            for {
-                result = nil
-                if err = iter.Next(&result); err != nil {
-                    break
-                }
-                if mapp, ok := result.(bson.M); ok {
-                    score, r1 := mapp["score"].(int)
-                    hash, r2 := mapp["hash"].(string)
-                    playerName := ds.UserNameFromHash(hash) // can be "" if user has unregistered!
-                    if r1 && r2 && playerName != "" {
-                        if !firsPlayerScoreRecord { strPlayerScoreRecord += ", " }
-                        strPlayerScoreRecord += "{ \"player\": \"" + 
-                                                   playerName + 
-                                                   "\", \"score\": " + 
-                                                   strconv.Itoa(score) + "}"
-                        firsPlayerScoreRecord = false
-                    }
-                }
+
+    selector := bson.M{"conversation": conv.ConvId}
+    var sent int64
+    var seen []string
+    if req.cursor != "" {
+        var ok bool
+        if sent, seen, ok = parseCursor(req.cursor); !ok {
+            jsonRes := "{\"result\": false, \"answer\": \"Invalid cursor in getConversation request\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        selector["$or"] = []bson.M{{"sent": bson.M{"$lt": sent}}, {"sent": sent, "msgid": bson.M{"$nin": seen}}}
+    } else if req.before > 0 {
+        selector["sent"] = bson.M{"$lt": req.before}
+    }
+    history := ds.DB(GUSTO_DB_NAME).C(CONVERSATION_MESSAGES)
+    query := history.Find(selector).Sort(bson.M{"sent": -1}).Limit(req.limit)
+
+    messages := make([]bson.M, 0, req.limit)
+    iterate(query, func(doc bson.M) {
+        messages = append(messages, bson.M{"id": doc["msgid"], "from": doc["from"],
+                                           "msg": doc["msg"], "sent": doc["sent"]})
+    })
+    if req.before == 0 && req.cursor == "" {
+        ds.markConversationRead(conv.ConvId, user.Name, time.Seconds())
+    }
+
+    next := ""
+    if len(messages) == req.limit {
+        next = pageCursor(messages, sent, seen)
+    }
+    jsonRes := "{\"result\": true, \"answer\": " + marshalList(messages) + ", \"cursor\": \"" + next + "\"}"
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+// A page cursor holds the time of the oldest message of the page, and the ids
+// of all the messages of that second already returned: messages sharing a
+// second come in no particular order, so the next page leaves those out by id
+// rather than skipping the whole second.
+func pageCursor(messages []bson.M, sent int64, seen []string) string {
+    oldest, _ := messages[len(messages) - 1]["sent"].(int64)
+    if oldest != sent {
+        seen = nil
+    }
+    ids := append([]string{}, seen...)
+    for _, m := range messages {
+        if t, _ := m["sent"].(int64); t == oldest {
+            if id, ok := m["id"].(string); ok {
+                ids = append(ids, id)
             }
-            //fmt.Printf("\nPlayerScore: %s\n", strPlayerScoreRecord)
         }
-        
-        if !firstGameRecord { strGamePlayerScore += ", " }
-        mapPlayerScore += (strPlayerScoreRecord + " ]")
-        strGamePlayerScore += "{\"game\": \"" + games[i] + "\", \"scores\": " + mapPlayerScore + "}"
-        firstGameRecord = false
-        
-        fmt.Printf("\nGamePlayerScore: %s\n", strGamePlayerScore)
     }
-    
-    mainAnswerStr += strGamePlayerScore + " ]"
-    mainJsonRes := "{\"result\": " + mainResultStr + ", \"answer\":" + mainAnswerStr + "}"
-    
-    fmt.Printf("\nGetLeaderBoard -->: %s\n", mainJsonRes)
-    
-    return &datatypes.GenericResponse{mainJsonRes}
+    return strconv.Itoa64(oldest) + ":" + strings.Join(ids, ",")
+}
+
+func parseCursor(cursor string) (sent int64, seen []string, ok bool) {
+    parts := strings.Split(cursor, ":")
+    if len(parts) != 2 {
+        return 0, nil, false
+    }
+    sent, err := strconv.Atoi64(parts[0])
+    if err != nil {
+        return 0, nil, false
+    }
+    if parts[1] != "" {
+        seen = strings.Split(parts[1], ",")
+    }
+    return sent, seen, true
+}
+
+///////
+// Block lists and reports of abusive messages
+
+type blockUser struct {
+    hash string
+    player string
+    block bool /* false to unblock */
+}
+
+func NewBlockUser(hash string, player string, block bool) *blockUser {
+    return &blockUser{hash, player, block}
+}
+
+//
+// { "verb": "blockUser" | "unblockUser", "hash": <user-id>, "player": <name or profile id> }
+// { "result": true, "answer": "" }
+//
+func (req *blockUser) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in the request\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    user, r1 := ds.caller(req.hash)
+    player, r2 := ds.lookupUser(req.player)
+    if !r1 || !r2 || user.Hash == player.Hash {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    blocks := ds.DB(GUSTO_DB_NAME).C(BLOCKED_USERS)
+    entry := bson.M{"owner": user.Name, "blocked": player.Name}
+    var err os.Error
+    if req.block {
+        err = blocks.Upsert(entry, entry)
+    } else {
+        err = blocks.RemoveAll(entry)
+    }
+
+    jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+    if err == nil {
+        jsonRes = "{\"result\": true, \"answer\": \"\"}"
+    }
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+type getBlockedUsers struct {
+    hash string
 }
 
+func NewGetBlockedUsers(hash string) *getBlockedUsers {
+    return &getBlockedUsers{hash}
+}
+
+//
+// { "verb": "getBlockedUsers", "hash": <user-id> }
+// { "result": true, "answer": [zero-or-more <name>] }
+//
+func (req *getBlockedUsers) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    names := make([]string, 0)
+    blocks := ds.DB(GUSTO_DB_NAME).C(BLOCKED_USERS)
+    iterate(blocks.Find(bson.M{"owner": user.Name}), func(doc bson.M) {
+        if name, ok := doc["blocked"].(string); ok {
+            names = append(names, name)
+        }
+    })
+    return &datatypes.GenericResponse{jsonAnswer(names)}
+}
+
+// blocked tells whether owner has blocked the other user
+func (ds *DBSession) blocked(owner string, other string) bool {
+    blocks := ds.DB(GUSTO_DB_NAME).C(BLOCKED_USERS)
+    n, err := blocks.Find(bson.M{"owner": owner, "blocked": other}).Count()
+    return err == nil && n > 0
+}
+
+type reportMessage struct {
+    hash string
+    id string
+    reason string
+}
+
+func NewReportMessage(hash string, id string, reason string) *reportMessage {
+    return &reportMessage{hash, id, reason}
+}
+
+//
+// { "verb": "reportMessage", "hash": <user-id>, "id": <message id>, "reason": <text> }
+// { "result": true, "answer": "" }
+//
+// Only messages still in the reporter's inbox can be reported. The reported
+// message is kept for review, and its sender is blocked for the reporter.
+func (req *reportMessage) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    var message datatypes.ShortTextMessage
+    messages := ds.DB(GUSTO_DB_NAME).C(TEXT_MESSAGES)
+    if messages.Find(bson.M{"msgid": req.id, "to": user.Name}).One(&message) != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Unknown message specified in reportMessage request\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    reports := ds.DB(GUSTO_DB_NAME).C(MESSAGE_REPORTS)
+    report := bson.M{"reporter": user.Name, "msgid": message.MsgId, "from": message.From,
+                     "msg": message.Msg, "sent": message.Sent, "reason": req.reason,
+                     "reported": time.Seconds()}
+    jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+    if reports.Insert(report) == nil {
+        blocks := ds.DB(GUSTO_DB_NAME).C(BLOCKED_USERS)
+        entry := bson.M{"owner": user.Name, "blocked": message.From}
+        blocks.Upsert(entry, entry)
+        messages.RemoveAll(bson.M{"msgid": message.MsgId, "to": user.Name})
+        jsonRes = "{\"result\": true, \"answer\": \"\"}"
+    }
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+type leaderBoardRequest struct {
+    hash string
+    game string
+    window int /* > 0 for the slice around the player */
+}
+
+func NewLeaderBoardRequest(hash string) *leaderBoardRequest {
+    return &leaderBoardRequest{hash, "", 0}
+}
+
+func NewAroundMeLeaderBoardRequest(hash string, game string, window int) *leaderBoardRequest {
+    return &leaderBoardRequest{hash, game, window}
+}
+
+func (req *leaderBoardRequest) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    user, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in getLeaderBoard request\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    if req.window > 0 {
+        return ds.aroundMeLeaderBoard(req.hash, req.game, req.window)
+    }
+
+    //
+    // {result: true, answer: [{"game": "Boondh", scores: [{"player": "siddu", "displayName": "Siddu", "score": 80}, ...] }, {"game": "Three Monkeys", "scores": [{}, {}, {}] }]
+    games, rankings, ok := leaderBoards.get(ds.leaderBoardGames, ds.buildLeaderBoard)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    // shadow banned players see their own scores ranked, as if nothing happened
+    if user.Status == datatypes.AccountShadow {
+        gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
+        iterate(gameScores.Find(bson.M{"hash": user.Hash}), func(doc bson.M) {
+            game, r1 := doc["game"].(string)
+            score, r2 := doc["score"].(int)
+            if r1 && r2 {
+                entry := bson.M{"player": user.Name, "displayName": user.DisplayName, "score": score}
+                rankings[game] = withOwnScore(rankings[game], entry, LEADERBOARD_SIZE)
+            }
+        })
+    }
+
+    answer := make([]interface{}, 0, len(games))
+    for _, game := range games {
+        answer = append(answer, bson.M{"game": game, "scores": rankings[game]})
+    }
+
+    mainJsonRes := jsonAnswer(answer)
+    fmt.Printf("\nGetLeaderBoard -->: %s\n", mainJsonRes)
+
+    return &datatypes.GenericResponse{mainJsonRes}
+}
+
+//
+// {result: true, answer: {"game": "Boondh", "rank": 42, "scores": [{"rank": 40, "player": "siddu", "displayName": "Siddu", "score": 80}, ...]}}
+//
+// The window is collected with two index friendly queries walking away from
+// the player's score in both directions, so it costs the same wherever the
+// player is ranked. The window is centered on the player when it can be, and
+// filled from the other side near the top or the bottom of the board. Ranks
+// are counts of the better scores, so tied scores share a rank.
+func (ds *DBSession) aroundMeLeaderBoard(hash string, game string, window int) datatypes.Response {
+    gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
+    visible := bson.M{"$ne": true}
+
+    var mine interface{}
+    err := gameScores.Find(bson.M{"hash": hash, "game": game}).
+                      Select(bson.M{"score": 1, "_id": 0}).One(&mine)
+    data, ok := mine.(bson.M)
+    if err != nil || !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"No ranked score for this game\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    score, _ := data["score"].(int)
+
+    better, err := gameScores.Find(bson.M{"game": game, "shadow": visible,
+                                          "score": bson.M{"$gt": score}}).Count()
+    if err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    rank := better + 1
+
+    fields := bson.M{"hash": 1, "score": 1, "_id": 0}
+    var above, below []bson.M
+    collect := func(list *[]bson.M) func(bson.M) {
+        return func(doc bson.M) { *list = append(*list, doc) }
+    }
+
+    // up to a full window on both sides, nearest scores first.
+    // NOTE: Limit(0) means no limit at all, hence the guards
+    if n := window - 1; n > 0 {
+        iterate(gameScores.Find(bson.M{"game": game, "shadow": visible,
+                                       "score": bson.M{"$gt": score}}).
+                           Sort(bson.M{"score": 1}).Limit(n).Select(fields), collect(&above))
+        iterate(gameScores.Find(bson.M{"game": game, "shadow": visible,
+                                       "score": bson.M{"$lte": score}, "hash": bson.M{"$ne": hash}}).
+                           Sort(bson.M{"score": -1}).Limit(n).Select(fields), collect(&below))
+    }
+    nAbove, nBelow := splitWindow(len(above), len(below), window)
+    above, below = above[:nAbove], below[:nBelow]
+
+    entries := make([]bson.M, 0, window)
+    for i := len(above) - 1; i >= 0; i-- {
+        entries = append(entries, above[i])
+    }
+    entries = append(entries, bson.M{"hash": hash, "score": score})
+    entries = append(entries, below...)
+
+    hashes := make([]string, 0, len(entries))
+    scores := make([]int, 0, len(entries))
+    for _, entry := range entries {
+        h, _ := entry["hash"].(string)
+        s, _ := entry["score"].(int)
+        hashes = append(hashes, h)
+        scores = append(scores, s)
+    }
+    users := ds.usersByHash(hashes)
+
+    // the best scores in the window may have ties beyond it
+    topRank := rank
+    if len(above) > 0 {
+        n, err := gameScores.Find(bson.M{"game": game, "shadow": visible,
+                                         "score": bson.M{"$gt": scores[0]}}).Count()
+        if err != nil {
+            jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        topRank = n + 1
+    }
+    ranks := windowRanks(scores, len(above), rank, topRank)
+
+    board := make([]bson.M, 0, len(entries))
+    for i, h := range hashes {
+        if user, found := users[h]; found {
+            board = append(board, bson.M{"rank": ranks[i], "player": user["name"],
+                                         "displayName": user["displayname"],
+                                         "score": scores[i]})
+        }
+    }
+
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"game": game, "rank": rank, "scores": board})}
+}
+
+// splitWindow shares the window - 1 places around the player between the
+// better and the worse scores available, half each when there are enough.
+func splitWindow(availableAbove int, availableBelow int, window int) (above int, below int) {
+    places := window - 1
+    above = min(availableAbove, places / 2)
+    below = min(availableBelow, places - above)
+    above = min(availableAbove, places - below)
+    return above, below
+}
+
+func min(a int, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// windowRanks ranks a window of scores sorted from the best, the player's at
+// index mine ranked rank, and the best ones ranked topRank. All the scores
+// between the best and the worst of the window are in it, but maybe for
+// some ties of these two.
+func windowRanks(scores []int, mine int, rank int, topRank int) []int {
+    ranks := make([]int, len(scores))
+    for i, score := range scores {
+        switch {
+        case i > 0 && score == scores[i-1]:
+            ranks[i] = ranks[i-1]
+        case i == 0 && mine > 0:
+            ranks[i] = topRank
+        case i < mine:
+            // every score from here down to the player's is better
+            ranks[i] = rank - (mine - i)
+        default:
+            ranks[i] = rank + (i - mine)
+        }
+    }
+    return ranks
+}
+
+///////
+// Leaderboards are served from an in-process ranking cache instead of being
+// recomputed on every request. Rankings are cached per game: a rebuild costs
+// one query for the game's top scores plus a single bulk query that joins in
+// the player names. setScore drops the ranking of its game, changes touching
+// a player everywhere (unregister, renames) drop them all. Rebuilds run
+// outside of the lock, and are only kept when nothing was invalidated during
+// the rebuild.
+
+const LEADERBOARD_SIZE = 5
+
+type leaderBoardCache struct {
+    sync.Mutex
+    games    []string            // nil until listed
+    rankings map[string][]bson.M // per game, missing until (re)built
+    changes  map[string]int      // invalidations per game, "" for the list of games
+    epoch    int                 // invalidations of everything
+}
+
+func newLeaderBoardCache() *leaderBoardCache {
+    return &leaderBoardCache{rankings: make(map[string][]bson.M), changes: make(map[string]int)}
+}
+
+var leaderBoards = newLeaderBoardCache()
+
+// InvalidateLeaderBoard discards the cached ranking of a game.
+func InvalidateLeaderBoard(game string) {
+    leaderBoards.invalidate(game)
+}
+
+// InvalidateLeaderBoards discards the cached rankings of all games.
+func InvalidateLeaderBoards() {
+    leaderBoards.invalidateAll()
+}
+
+func (lb *leaderBoardCache) invalidate(game string) {
+    lb.Lock()
+    defer lb.Unlock()
+
+    lb.rankings[game] = nil, false
+    lb.changes[game]++
+    for _, g := range lb.games {
+        if g == game {
+            return
+        }
+    }
+    // a game seen for the first time
+    lb.games = nil
+    lb.changes[""]++
+}
+
+func (lb *leaderBoardCache) invalidateAll() {
+    lb.Lock()
+    defer lb.Unlock()
+
+    lb.games = nil
+    lb.rankings = make(map[string][]bson.M)
+    lb.epoch++
+}
+
+// get returns the rankings of all games, listing the games and building the
+// missing rankings with the given functions.
+func (lb *leaderBoardCache) get(list func() ([]string, bool), build func(game string) ([]bson.M, bool)) (games []string, rankings map[string][]bson.M, ok bool) {
+    lb.Lock()
+    games, epoch, listed := lb.games, lb.epoch, lb.changes[""]
+    lb.Unlock()
+
+    if games == nil {
+        if games, ok = list(); !ok {
+            return nil, nil, false
+        }
+        lb.Lock()
+        if lb.epoch == epoch && lb.changes[""] == listed {
+            lb.games = games
+        }
+        lb.Unlock()
+    }
+
+    rankings = make(map[string][]bson.M, len(games))
+    changes := make(map[string]int)
+    lb.Lock()
+    for _, game := range games {
+        if scores, found := lb.rankings[game]; found {
+            rankings[game] = scores
+        } else {
+            changes[game] = lb.changes[game]
+        }
+    }
+    epoch = lb.epoch
+    lb.Unlock()
+
+    for game, seen := range changes {
+        scores, ok := build(game)
+        if !ok {
+            return nil, nil, false
+        }
+        rankings[game] = scores
+
+        lb.Lock()
+        if lb.epoch == epoch && lb.changes[game] == seen {
+            lb.rankings[game] = scores
+        }
+        lb.Unlock()
+    }
+    return games, rankings, true
+}
+
+func (ds *DBSession) leaderBoardGames() (games []string, ok bool) {
+    gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
+    if err := gameScores.Find(nil).Distinct("game", &games); err != nil {
+        return nil, false
+    }
+    return games, true
+}
+
+func (ds *DBSession) buildLeaderBoard(game string) (scores []bson.M, ok bool) {
+    gameScores := ds.DB(GUSTO_DB_NAME).C(GAME_SCORES)
+
+    // top scores of the game, keyed by the player's hash for now
+    var topScores []bson.M
+    var hashes []string
+    query := gameScores.Find(bson.M{"game": game, "shadow": bson.M{"$ne": true}}).
+                        Sort(bson.M{"score": -1}).Limit(LEADERBOARD_SIZE).
+                            Select(bson.M{"hash": 1, "score": 1, "_id": 0})
+    iterate(query, func(doc bson.M) {
+        score, r1 := doc["score"].(int)
+        hash, r2 := doc["hash"].(string)
+        if r1 && r2 {
+            topScores = append(topScores, bson.M{"hash": hash, "score": score})
+            hashes = append(hashes, hash)
+        }
+    })
+
+    // one round-trip for the names of everyone on the leaderboard
+    users := ds.usersByHash(hashes)
+
+    scores = make([]bson.M, 0, LEADERBOARD_SIZE)
+    for _, entry := range topScores {
+        // players who have unregistered are missing from the map
+        if user, found := users[entry["hash"].(string)]; found {
+            scores = append(scores, bson.M{"player": user["name"],
+                                           "displayName": user["displayname"],
+                                           "score": entry["score"]})
+        }
+    }
+    return scores, true
+}
+
+// withOwnScore returns a copy of the ranking with the entry ranked in, after
+// the scores it ties with, unless it does not make the cut
+func withOwnScore(scores []bson.M, entry bson.M, size int) []bson.M {
+    score, _ := entry["score"].(int)
+    at := len(scores)
+    for i, other := range scores {
+        if s, _ := other["score"].(int); s < score {
+            at = i
+            break
+        }
+    }
+    if at >= size {
+        return scores
+    }
+
+    ranked := make([]bson.M, 0, len(scores) + 1)
+    ranked = append(ranked, scores[:at]...)
+    ranked = append(ranked, entry)
+    ranked = append(ranked, scores[at:]...)
+    if len(ranked) > size {
+        ranked = ranked[:size]
+    }
+    return ranked
+}
+
+// usersByHash fetches the name and display name of the given users in a
+// single query.
+func (ds *DBSession) usersByHash(hashes []string) map[string]bson.M {
+    users := make(map[string]bson.M, len(hashes))
+    if len(hashes) == 0 {
+        return users
+    }
+
+    c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    query := c.Find(bson.M{"hash": bson.M{"$in": hashes}}).
+                   Select(bson.M{"hash": 1, "name": 1, "displayname": 1, "_id": 0})
+    iterate(query, func(doc bson.M) {
+        if hash, ok := doc["hash"].(string); ok {
+            users[hash] = doc
+        }
+    })
+    return users
+}
+
+///////
+// Friends. An invitation is recorded as a pending friendship from the
+// inviting to the invited user, and the friendship is accepted by the
+// invited user. Inviting somebody who already sent you an invitation
+// accepts that invitation.
+
+func friendshipBetween(a string, b string) bson.M {
+    return bson.M{"$or": []bson.M{{"from": a, "to": b}, {"from": b, "to": a}}}
+}
+
+// friendNames lists the names of the user's friends
+func (ds *DBSession) friendNames(name string) []string {
+    var friends []string
+    friendships := ds.DB(GUSTO_DB_NAME).C(FRIENDSHIPS)
+    query := friendships.Find(bson.M{"status": datatypes.FriendshipAccepted,
+                                     "$or": []bson.M{{"from": name}, {"to": name}}})
+    iterate(query, func(doc bson.M) {
+        from, _ := doc["from"].(string)
+        to, _ := doc["to"].(string)
+        if from == name {
+            friends = append(friends, to)
+        } else {
+            friends = append(friends, from)
+        }
+    })
+    return friends
+}
+
+// befriend records an accepted friendship unless the users already are
+// friends, or one has blocked the other
+func (ds *DBSession) befriend(a string, b string) bool {
+    if a == b || ds.blocked(a, b) || ds.blocked(b, a) {
+        return false
+    }
+    friendships := ds.DB(GUSTO_DB_NAME).C(FRIENDSHIPS)
+    friendships.RemoveAll(friendshipBetween(a, b))
+    friendship := datatypes.Friendship{a, b, datatypes.FriendshipAccepted, time.Seconds()}
+    if friendships.Insert(&friendship) != nil {
+        return false
+    }
+    publish(a, bson.M{"event": "friendAccepted", "player": b})
+    publish(b, bson.M{"event": "friendAccepted", "player": a})
+    return true
+}
+
+type friendRequest struct {
+    verb string
+    hash string
+    player string
+}
+
+func NewFriendRequest(verb string, hash string, player string) *friendRequest {
+    return &friendRequest{verb, hash, player}
+}
+
+//
+// { "verb": "inviteFriend" | "acceptFriend" | "declineFriend" | "removeFriend", "hash": <user-id>, "player": <name or profile id> }
+// { "result": true, "answer": "" }
+//
+func (req *friendRequest) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid user specified in " + req.verb + " request\"}"
+
+    ds := NewSession()
+    defer ds.Close()
+
+    user, r1 := ds.caller(req.hash)
+    player, r2 := ds.lookupUser(req.player)
+    if !r1 || !r2 || user.Hash == player.Hash {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    friendships := ds.DB(GUSTO_DB_NAME).C(FRIENDSHIPS)
+    invitation := bson.M{"from": player.Name, "to": user.Name, "status": datatypes.FriendshipPending}
+    pending, _ := friendships.Find(invitation).Count()
+
+    ok := false
+    switch req.verb {
+    case "inviteFriend":
+        var already bool
+        if ok, already = ds.invite(user.Name, player.Name); already {
+            jsonRes = "{\"result\": false, \"answer\": \"Already friends or invited\"}"
+        }
+    case "acceptFriend":
+        ok = pending > 0 && ds.befriend(player.Name, user.Name)
+    case "declineFriend":
+        ok = pending > 0 && friendships.RemoveAll(invitation) == nil
+    case "removeFriend":
+        friendship := friendshipBetween(user.Name, player.Name)
+        friendship["status"] = datatypes.FriendshipAccepted
+        ok = friendships.RemoveAll(friendship) == nil
+    }
+
+    if ok {
+        jsonRes = "{\"result\": true, \"answer\": \"\"}"
+    }
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+// invite sends an invitation, or accepts the one the invited user already
+// sent. already is true when the users are friends or invited already.
+func (ds *DBSession) invite(from string, to string) (ok bool, already bool) {
+    friendships := ds.DB(GUSTO_DB_NAME).C(FRIENDSHIPS)
+    pending, _ := friendships.Find(bson.M{"from": to, "to": from, "status": datatypes.FriendshipPending}).Count()
+    existing, _ := friendships.Find(friendshipBetween(from, to)).Count()
+    switch {
+    case pending > 0:
+        return ds.befriend(to, from), false
+    case existing > 0:
+        return false, true
+    case ds.blocked(to, from):
+        // do not let on that the invitation goes nowhere
+        return true, false
+    }
+
+    friendship := datatypes.Friendship{from, to, datatypes.FriendshipPending, time.Seconds()}
+    if friendships.Insert(&friendship) != nil {
+        return false, false
+    }
+    publish(to, bson.M{"event": "friendInvite", "player": from})
+    return true, false
+}
+
+type listFriends struct {
+    hash string
+}
+
+func NewListFriends(hash string) *listFriends {
+    return &listFriends{hash}
+}
+
+//
+// { "verb": "listFriends", "hash": <user-id> }
+// { "result": true, "answer": {"friends": [zero-or-more{"name": <name>, "displayName": <name>, "online": <bool>}],
+//                              "invitations": [zero-or-more{"name": <name>, "displayName": <name>}]} }
+//
+func (req *listFriends) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    names := ds.friendNames(user.Name)
+    friends := make([]bson.M, 0, len(names))
+    for _, doc := range ds.usersByName(names) {
+        name, _ := doc["name"].(string)
+        hash, _ := doc["hash"].(string)
+        persisted, _ := doc["lastseen"].(int64)
+        online, _ := presence(name, hash, persisted)
+        friends = append(friends, bson.M{"name": name, "displayName": doc["displayname"], "online": online})
+    }
+
+    var inviters []string
+    friendships := ds.DB(GUSTO_DB_NAME).C(FRIENDSHIPS)
+    iterate(friendships.Find(bson.M{"to": user.Name, "status": datatypes.FriendshipPending}), func(doc bson.M) {
+        if from, ok := doc["from"].(string); ok {
+            inviters = append(inviters, from)
+        }
+    })
+    invitations := make([]bson.M, 0, len(inviters))
+    for _, doc := range ds.usersByName(inviters) {
+        invitations = append(invitations, bson.M{"name": doc["name"], "displayName": doc["displayname"]})
+    }
+
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"friends": friends, "invitations": invitations})}
+}
+
+// usersByName fetches the name and display name of the given users in a
+// single query.
+func (ds *DBSession) usersByName(names []string) []bson.M {
+    users := make([]bson.M, 0, len(names))
+    if len(names) == 0 {
+        return users
+    }
+
+    c := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    query := c.Find(bson.M{"name": bson.M{"$in": names}}).
+                   Select(bson.M{"name": 1, "displayname": 1, "hash": 1, "lastseen": 1, "_id": 0})
+    iterate(query, func(doc bson.M) {
+        users = append(users, doc)
+    })
+    return users
+}
+
+type importFriends struct {
+    hash string
+    profile string
+    ids []string
+}
+
+func NewImportFriends(hash string, profile string, ids []string) *importFriends {
+    return &importFriends{hash, profile, ids}
+}
+
+//
+// { "verb": "importFriends", "hash": <user-id>, "profile": "fb" | "tw" | "99", "ids": [one-or-more <profile id>] }
+// { "result": true, "answer": [zero-or-more <name of an invited player>] }
+//
+// Invites the Marvin users behind a list of ids of the user's friends on an
+// external network. Users who already invited the user become friends.
+func (req *importFriends) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    user, ok := ds.caller(req.hash)
+    if !ok {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    invited := make([]string, 0)
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    query := users.Find(bson.M{"profile": req.profile, "profileid": bson.M{"$in": req.ids}}).
+                   Select(bson.M{"name": 1, "_id": 0})
+    var names []string
+    iterate(query, func(doc bson.M) {
+        if name, _ := doc["name"].(string); name != "" && name != user.Name {
+            names = append(names, name)
+        }
+    })
+    for _, name := range names {
+        if ok, _ := ds.invite(user.Name, name); ok {
+            invited = append(invited, name)
+        }
+    }
+    return &datatypes.GenericResponse{jsonAnswer(invited)}
+}
+
+///////
+// Events pushed to connected clients: "message", "friendInvite",
+// "friendAccepted" and "presence". Coin requests and gifts arrive as system
+// messages. Every user's events are published to the hub under the
+// user's name.
+
+func publish(key string, event bson.M) {
+    if data, err := json.Marshal(event); err == nil {
+        hub.Publish(key, string(data))
+    }
+}
+
+// Authenticate returns the name of the user owning the hash or device
+// credential
+func Authenticate(hash string) (name string, ok bool) {
+    a := cachedAccount(hash)
+    if a.name == "" {
+        return "", false
+    }
+    if refused, _ := refusedAccount(a.status, a.until); refused {
+        return "", false
+    }
+    return a.name, true
+}
+
+// Users are online while they have a connection open. A user can be
+// connected from several devices at once.
+var connections = struct {
+    sync.Mutex
+    count map[string]int
+}{count: make(map[string]int)}
+
+// SetOnline records that a user connected or disconnected, and announces it
+// to the user's friends when the user comes online or goes offline.
+func SetOnline(name string, online bool) {
+    connections.Lock()
+    n := connections.count[name]
+    if online {
+        n++
+    } else {
+        n--
+    }
+    if n > 0 {
+        connections.count[name] = n
+    } else {
+        connections.count[name] = 0, false
+    }
+    connections.Unlock()
+
+    if (online && n == 1) || (!online && n == 0) {
+        ds := NewSession()
+        defer ds.Close()
+
+        event := bson.M{"event": "presence", "player": name, "online": online}
+        for _, friend := range ds.friendNames(name) {
+            publish(friend, event)
+        }
+    }
+}
+
+func IsOnline(name string) bool {
+    connections.Lock()
+    defer connections.Unlock()
+    return connections.count[name] > 0
+}
+
+///////
+// Last seen times. Every authenticated request touches its caller; the time
+// is kept in memory and written through to the user's record at most once a
+// minute. A user is online while connected, or seen within the threshold.
+//
+// The accounts behind the hashes and device credentials of recent requests
+// are cached for a while, unknown ones included, so that resolving, admitting
+// and touching the caller of a request costs no query but the periodic write.
+// Changing the hash or the status of an account forgets it.
+
+const LAST_SEEN_WRITE_INTERVAL = 60
+const ACCOUNT_CACHE_SECONDS = 60
+
+type account struct {
+    hash      string // the account's own hash, for a device credential
+    name      string // "" for an unknown hash
+    status    string
+    until     int64
+    loaded    int64
+    seen      int64
+    persisted int64
+}
+
+var accounts = struct {
+    sync.Mutex
+    byHash    map[string]*account
+    swept     int64
+    threshold int64
+}{byHash: make(map[string]*account), threshold: 120}
+
+// SetOnlineThreshold configures how many seconds after the last sign of
+// life a user still counts as online
+func SetOnlineThreshold(seconds int64) {
+    accounts.Lock()
+    accounts.threshold = seconds
+    accounts.Unlock()
+}
+
+func onlineThreshold() int64 {
+    accounts.Lock()
+    defer accounts.Unlock()
+    return accounts.threshold
+}
+
+// cachedAccount returns the account owning the hash or device credential,
+// from the cache when it is fresh enough
+func cachedAccount(hash string) account {
+    now := time.Seconds()
+    accounts.Lock()
+    if a, found := accounts.byHash[hash]; found && now - a.loaded < ACCOUNT_CACHE_SECONDS {
+        defer accounts.Unlock()
+        return *a
+    }
+    accounts.Unlock()
+
+    ds := NewSession()
+    defer ds.Close()
+
+    fresh := account{loaded: now}
+    var record interface{}
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    fields := bson.M{"hash": 1, "name": 1, "lastseen": 1, "status": 1, "until": 1, "_id": 0}
+    err := users.Find(bson.M{"hash": hash}).Select(fields).One(&record)
+    if err != nil && hash != "" {
+        var device datatypes.Device
+        if ds.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES).Find(bson.M{"credential": hash}).One(&device) == nil {
+            err = users.Find(bson.M{"name": device.Owner}).Select(fields).One(&record)
+        }
+    }
+    if data, ok := record.(bson.M); err == nil && ok {
+        fresh.hash, _ = data["hash"].(string)
+        fresh.name, _ = data["name"].(string)
+        fresh.status, _ = data["status"].(string)
+        fresh.until, _ = data["until"].(int64)
+        fresh.persisted, _ = data["lastseen"].(int64)
+        fresh.seen = fresh.persisted
+    }
+
+    accounts.Lock()
+    defer accounts.Unlock()
+    sweepAccounts(now)
+    if a, found := accounts.byHash[hash]; found && a.name == fresh.name {
+        // signs of life not written yet
+        if a.seen > fresh.seen {
+            fresh.seen = a.seen
+        }
+        if a.persisted > fresh.persisted {
+            fresh.persisted = a.persisted
+        }
+    }
+    accounts.byHash[hash] = &fresh
+    return fresh
+}
+
+// sweepAccounts drops the stale entries with nothing left to write, once in
+// a while. The caller holds the lock.
+func sweepAccounts(now int64) {
+    if now - accounts.swept < ACCOUNT_CACHE_SECONDS {
+        return
+    }
+    for hash, a := range accounts.byHash {
+        if now - a.loaded >= ACCOUNT_CACHE_SECONDS && a.seen <= a.persisted {
+            accounts.byHash[hash] = nil, false
+        }
+    }
+    accounts.swept = now
+}
+
+// forgetAccount drops the cached account of a hash or credential that
+// changed hands, with the credentials of the devices standing for the hash
+func forgetAccount(hash string) {
+    accounts.Lock()
+    defer accounts.Unlock()
+
+    for key, a := range accounts.byHash {
+        if key == hash || a.hash == hash {
+            accounts.byHash[key] = nil, false
+        }
+    }
+}
+
+// AccountHash returns the hash of the account a hash or device credential
+// gives access to
+func AccountHash(credential string) (hash string, ok bool) {
+    a := cachedAccount(credential)
+    return a.hash, a.name != ""
+}
+
+// Touch records a sign of life of the user owning the hash
+func Touch(hash string) {
+    if cachedAccount(hash).name == "" {
+        return
+    }
+
+    now := time.Seconds()
+    accounts.Lock()
+    a, found := accounts.byHash[hash]
+    write := found && now - a.persisted >= LAST_SEEN_WRITE_INTERVAL
+    if found {
+        a.seen = now
+    }
+    if write {
+        a.persisted = now
+    }
+    accounts.Unlock()
+
+    if write {
+        ds := NewSession()
+        defer ds.Close()
+        ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS).Update(bson.M{"hash": hash}, bson.M{"$set": bson.M{"lastseen": now}})
+    }
+}
+
+func seenAt(hash string, persisted int64) int64 {
+    accounts.Lock()
+    defer accounts.Unlock()
+
+    if a, found := accounts.byHash[hash]; found && a.seen > persisted {
+        return a.seen
+    }
+    return persisted
+}
+
+// presence tells whether a user is online, and when the user was last seen,
+// from the last seen time in the user's record
+func presence(name string, hash string, persisted int64) (online bool, seen int64) {
+    seen = seenAt(hash, persisted)
+    return onlineAt(IsOnline(name), seen, time.Seconds(), onlineThreshold()), seen
+}
+
+func onlineAt(connected bool, seen int64, now int64, threshold int64) bool {
+    return connected || (seen > 0 && now - seen <= threshold)
+}
+
+type heartbeat struct {
+    hash string
+}
+
+func NewHeartbeat(hash string) *heartbeat {
+    return &heartbeat{hash}
+}
+
+//
+// { "verb": "heartbeat", "hash": <user-id> }
+// { "result": true, "answer": <server time> }
+//
+// Does nothing by itself: like any other request, it touches the caller.
+func (req *heartbeat) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    if !ds.validUserHash(req.hash) {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{jsonAnswer(time.Seconds())}
+}
+
+type getOnlineStatus struct {
+    hash string
+    players []string
+}
+
+func NewGetOnlineStatus(hash string, players []string) *getOnlineStatus {
+    return &getOnlineStatus{hash, players}
+}
+
+//
+// { "verb": "getOnlineStatus", "hash": <user-id>, "players": [one-or-more <name or profile id>] }
+// { "result": true, "answer": [zero-or-more{"player": <as requested>, "name": <name>, "online": <bool>, "lastSeen": <time or 0>}] }
+//
+func (req *getOnlineStatus) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+
+    if !ds.validUserHash(req.hash) {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+
+    // everybody in a single query
+    var docs []bson.M
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    query := users.Find(bson.M{"$or": []bson.M{{"hash": bson.M{"$in": req.players}},
+                                               {"name": bson.M{"$in": req.players}},
+                                               {"profileid": bson.M{"$in": req.players}}}}).
+                   Select(bson.M{"hash": 1, "name": 1, "profileid": 1, "lastseen": 1, "_id": 0})
+    iterate(query, func(doc bson.M) { docs = append(docs, doc) })
+    found := resolveIds(req.players, docs)
+
+    answer := make([]bson.M, 0, len(req.players))
+    for _, id := range req.players {
+        doc, ok := found[id]
+        if !ok {
+            continue
+        }
+        hash, _ := doc["hash"].(string)
+        name, _ := doc["name"].(string)
+        persisted, _ := doc["lastseen"].(int64)
+
+        online, seen := presence(name, hash, persisted)
+        answer = append(answer, bson.M{"player": id, "name": name, "online": online, "lastSeen": seen})
+    }
+    return &datatypes.GenericResponse{jsonAnswer(answer)}
+}
+
+// resolveIds matches ids with the user records found for them the way
+// lookupUser does: by hash first, then by name, then by profile id.
+func resolveIds(ids []string, docs []bson.M) map[string]bson.M {
+    byField := map[string]map[string]bson.M{"hash": {}, "name": {}, "profileid": {}}
+    for _, doc := range docs {
+        for field, index := range byField {
+            if value, ok := doc[field].(string); ok && value != "" {
+                index[value] = doc
+            }
+        }
+    }
+
+    found := make(map[string]bson.M, len(ids))
+    for _, id := range ids {
+        for _, field := range []string{"hash", "name", "profileid"} {
+            if doc, ok := byField[field][id]; ok {
+                found[id] = doc
+                break
+            }
+        }
+    }
+    return found
+}
+
+///////
+// Rate limits. A RateLimiter allows each key at most max events in every
+// window of seconds; the keys idle for a whole window are forgotten.
+
+type RateLimiter struct {
+    sync.Mutex
+    max    int
+    window int64
+    events map[string][]int64
+    swept  int64
+}
+
+func NewRateLimiter(max int, window int64) *RateLimiter {
+    return &RateLimiter{max: max, window: window, events: make(map[string][]int64)}
+}
+
+// Set changes the limit
+func (rl *RateLimiter) Set(max int, window int64) {
+    rl.Lock()
+    rl.max, rl.window = max, window
+    rl.Unlock()
+}
+
+// Allow records an event of the key, unless the key is over the limit
+func (rl *RateLimiter) Allow(key string) bool {
+    return rl.AllowAt(key, time.Seconds())
+}
+
+func (rl *RateLimiter) AllowAt(key string, now int64) bool {
+    rl.Lock()
+    defer rl.Unlock()
+
+    rl.sweep(now)
+    recent := rl.recent(key, now)
+    if len(recent) >= rl.max {
+        return false
+    }
+    rl.events[key] = append(recent, now)
+    return true
+}
+
+// Blocked tells whether the key is over the limit, without recording an
+// event. With Record, only some of the events count, failures say.
+func (rl *RateLimiter) Blocked(key string) bool {
+    return rl.BlockedAt(key, time.Seconds())
+}
+
+func (rl *RateLimiter) BlockedAt(key string, now int64) bool {
+    rl.Lock()
+    defer rl.Unlock()
+
+    rl.sweep(now)
+    return len(rl.recent(key, now)) >= rl.max
+}
+
+// Record records an event of the key, over the limit or not
+func (rl *RateLimiter) Record(key string) {
+    rl.RecordAt(key, time.Seconds())
+}
+
+func (rl *RateLimiter) RecordAt(key string, now int64) {
+    rl.Lock()
+    defer rl.Unlock()
+
+    rl.sweep(now)
+    rl.events[key] = append(rl.recent(key, now), now)
+}
+
+// recent drops the events of the key older than the window
+func (rl *RateLimiter) recent(key string, now int64) []int64 {
+    events := rl.events[key]
+    recent := events[:0]
+    for _, t := range events {
+        if now - t < rl.window {
+            recent = append(recent, t)
+        }
+    }
+    if len(recent) == 0 {
+        rl.events[key] = nil, false
+        return nil
+    }
+    rl.events[key] = recent
+    return recent
+}
+
+// sweep forgets the idle keys, once per window
+func (rl *RateLimiter) sweep(now int64) {
+    if now - rl.swept < rl.window {
+        return
+    }
+    for key, events := range rl.events {
+        if len(events) == 0 || now - events[len(events) - 1] >= rl.window {
+            rl.events[key] = nil, false
+        }
+    }
+    rl.swept = now
+}
+
+///////
+// Profiles. The display name is always public; the other fields may be
+// hidden from other players.
+
+var ProfileFields = []string{"avatarUrl", "locale", "country", "bio"}
+
+// DisplayKey normalizes a display name, two users cannot share the same key
+func DisplayKey(displayName string) string {
+    return strings.ToLower(strings.Join(strings.Fields(displayName), " "))
+}
+
+func profileOf(user *datatypes.User, private bool) bson.M {
+    profile := bson.M{"name": user.Name, "displayName": user.DisplayName}
+    fields := bson.M{"avatarUrl": user.AvatarURL, "locale": user.Locale, "country": user.Country, "bio": user.Bio}
+    
+    if !private {
+        for _, field := range user.Private {
+            fields[field] = "", false
+        }
+    }
+    for field, value := range fields {
+        profile[field] = value, true
+    }
+    if private {
+        hidden := user.Private
+        if hidden == nil {
+            hidden = []string{}
+        }
+        profile["private"] = hidden, true
+    }
+    return profile
+}
+
+type getProfile struct {
+    hash string
+    player string
+}
+
+func NewGetProfile(hash string, player string) *getProfile {
+    return &getProfile{hash, player}
+}
+
+//
+// { "verb": "getProfile", "hash": <user-id>, "player": <optional name or profile id, defaults to the caller> }
+// { "result": true, "answer": {"name": <name>, "displayName": <name>, "avatarUrl": <url>, "locale": <locale>,
+//                              "country": <code>, "bio": <text>, "private": [zero-or-more <field>]} }
+//
+// Private fields and the list of private fields are only returned to the owner.
+func (req *getProfile) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    caller, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    user := caller
+    if req.player != "" {
+        if user, found = ds.lookupUser(req.player); !found {
+            jsonRes := "{\"result\": false, \"answer\": \"Unknown player\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+    }
+    return &datatypes.GenericResponse{jsonAnswer(profileOf(user, user.Hash == caller.Hash))}
+}
+
+type updateProfile struct {
+    hash string
+    changes bson.M      /* fields to set, by their record names */
+    private []string    /* nil leaves the visibility unchanged */
+}
+
+func NewUpdateProfile(hash string, changes map[string]string, private []string) *updateProfile {
+    update := bson.M{}
+    for field, value := range changes {
+        update[strings.ToLower(field)] = value, true
+    }
+    return &updateProfile{hash, update, private}
+}
+
+//
+// { "verb": "updateProfile", "hash": <user-id>, "displayName": <optional>, "avatarUrl": <optional>,
+//   "locale": <optional>, "country": <optional>, "bio": <optional>, "private": <optional [zero-or-more <field>]> }
+// { "result": true, "answer": <the updated profile, as returned by getProfile> }
+//
+func (req *updateProfile) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    if displayName, ok := req.changes["displayname"].(string); ok {
+        key := DisplayKey(displayName)
+        if key != user.DisplayKey {
+            count, err := users.Find(bson.M{"displaykey": key, "hash": bson.M{"$ne": req.hash}}).Count()
+            if err != nil || count > 0 {
+                jsonRes := "{\"result\": false, \"answer\": \"Display name already taken\"}"
+                return &datatypes.GenericResponse{jsonRes}
+            }
+        }
+        req.changes["displaykey"] = key, true
+    }
+    if req.private != nil {
+        req.changes["private"] = req.private, true
+    }
+    
+    if len(req.changes) > 0 {
+        if users.Update(bson.M{"hash": req.hash}, bson.M{"$set": req.changes}) != nil {
+            jsonRes := "{\"result\": false, \"answer\": \"Profile update failed\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        if _, renamed := req.changes["displayname"]; renamed {
+            InvalidateLeaderBoards()
+        }
+        user, _ = ds.caller(req.hash)
+    }
+    return &datatypes.GenericResponse{jsonAnswer(profileOf(user, true))}
+}
+
+// iterate calls f for every document returned by the query.
+func iterate(query *mgo.Query, f func(bson.M)) {
+    iter, err := query.Iter()
+    if iter == nil || err != nil {
+        return
+    }
+
+    for {
+        var result interface{}
+        if err = iter.Next(&result); err != nil {
+            break
+        }
+        if doc, ok := result.(bson.M); ok {
+            f(doc)
+        }
+    }
+}
+
+// jsonAnswer wraps a successful answer into the standard response envelope.
+func jsonAnswer(answer interface{}) string {
+    data, err := json.Marshal(answer)
+    if err != nil {
+        return "{\"result\": false, \"answer\": \"Unknown error\"}"
+    }
+    return "{\"result\": true, \"answer\": " + string(data) + "}"
+}
+
+///////
+// Devices. The device an account was registered from holds the account's
+// hash; every device linked later gets a credential of its own, standing for
+// the hash, so that unlinking the device revokes it. A new device is linked
+// either with a code obtained on a linked device, or by signing in with the
+// account's name and password.
+
+const LINK_CODE_SECONDS = 600
+
+// failed sign-ins allowed per name
+const MAX_SIGN_IN_FAILURES = 5
+const SIGN_IN_FAILURE_SECONDS = 900
+
+var signInFailures = NewRateLimiter(MAX_SIGN_IN_FAILURES, SIGN_IN_FAILURE_SECONDS)
+
+// checkSignIn checks the password of the user with the given name, unless
+// the name saw too many failed attempts lately
+func (ds *DBSession) checkSignIn(name string, password string) (*datatypes.User, bool) {
+    if signInFailures.Blocked(name) {
+        return nil, false
+    }
+    user, found := ds.findUser(bson.M{"name": name})
+    if !found || !ds.signIn(user, password) {
+        signInFailures.Record(name)
+        return nil, false
+    }
+    return user, true
+}
+
+type requestLinkCode struct {
+    hash string
+}
+
+func NewRequestLinkCode(hash string) *requestLinkCode {
+    return &requestLinkCode{hash}
+}
+
+//
+// { "verb": "requestLinkCode", "hash": <user-id> }
+// { "result": true, "answer": {"code": <code>, "expires": <time>} }
+//
+func (req *requestLinkCode) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    if !ds.validUserHash(req.hash) {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    codes := ds.DB(GUSTO_DB_NAME).C(LINK_CODES)
+    now := time.Seconds()
+    codes.RemoveAll(bson.M{"$or": []bson.M{{"hash": req.hash}, {"expires": bson.M{"$lt": now}}}})
+    
+    secret, err := newSecret()
+    if err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    code := datatypes.LinkCode{strings.ToUpper(secret[:8]), req.hash, now + LINK_CODE_SECONDS}
+    if codes.Insert(&code) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"code": code.Code, "expires": code.Expires})}
+}
+
+type linkDevice struct {
+    code string
+    name string
+    password string
+    device datatypes.Device
+}
+
+func NewLinkDeviceByCode(code string, device string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *linkDevice {
+    return &linkDevice{strings.ToUpper(code), "", "", datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen, "", 0, ""}}
+}
+
+func NewLinkDeviceBySignIn(name string, password string, device string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *linkDevice {
+    return &linkDevice{"", name, password, datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen, "", 0, ""}}
+}
+
+//
+// { "verb": "linkDevice", "code": <code>, "deviceId": <device>, ... }
+// { "verb": "linkDevice", "name": <name>, "password": <password>, "deviceId": <device>, ... }
+// { "result": true, "answer": <user-id> }
+//
+// The user-id answered is the device's own credential.
+func (req *linkDevice) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid or expired link code\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+    
+    var user *datatypes.User
+    found := false
+    if req.code != "" {
+        var code datatypes.LinkCode
+        codes := ds.DB(GUSTO_DB_NAME).C(LINK_CODES)
+        selector := bson.M{"code": req.code, "expires": bson.M{"$gte": time.Seconds()}}
+        // a code links a single device
+        if codes.Find(selector).One(&code) == nil && codes.Remove(selector) == nil {
+            user, found = ds.caller(code.Hash)
+        }
+    } else {
+        jsonRes = "{\"result\": false, \"answer\": \"Wrong name or password\"}"
+        user, found = ds.checkSignIn(req.name, req.password)
+    }
+    if !found {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    credential, err := newSecret()
+    if err != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    req.device.Owner, req.device.Linked, req.device.Credential = user.Name, time.Seconds(), credential
+    
+    devices := ds.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES)
+    selector := bson.M{"deviceid": req.device.DeviceId, "owner": user.Name}
+    var previous datatypes.Device
+    if devices.Find(selector).One(&previous) == nil && previous.Credential != "" {
+        forgetAccount(previous.Credential)
+    }
+    if devices.Upsert(selector, &req.device) != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{jsonAnswer(credential)}
+}
+
+type listDevices struct {
+    hash string
+}
+
+func NewListDevices(hash string) *listDevices {
+    return &listDevices{hash}
+}
+
+//
+// { "verb": "listDevices", "hash": <user-id> }
+// { "result": true, "answer": [one-or-more{"deviceId": <device>, "os": <os>, "osVersion": <version>, "linked": <time>}] }
+//
+func (req *listDevices) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    answer := make([]bson.M, 0, 4)
+    devices := ds.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES)
+    iterate(devices.Find(bson.M{"owner": user.Name}).Sort(bson.M{"linked": 1}), func(doc bson.M) {
+        answer = append(answer, bson.M{"deviceId": doc["deviceid"], "os": doc["os"], "osVersion": doc["osver"], "linked": doc["linked"]})
+    })
+    return &datatypes.GenericResponse{jsonAnswer(answer)}
+}
+
+type unlinkDevice struct {
+    hash string
+    device string
+}
+
+func NewUnlinkDevice(hash string, device string) *unlinkDevice {
+    return &unlinkDevice{hash, device}
+}
+
+//
+// { "verb": "unlinkDevice", "hash": <user-id>, "deviceId": <device> }
+// { "result": true, "answer": "" }
+//
+// The device's credential stops working. Unlinking a device holding the
+// account's hash gives the account a new hash, known to no device: the other
+// devices keep working through their own credentials.
+func (req *unlinkDevice) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    var device datatypes.Device
+    devices := ds.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES)
+    selector := bson.M{"deviceid": req.device, "owner": user.Name}
+    if devices.Find(selector).One(&device) != nil || devices.Remove(selector) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a linked device\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    if device.Credential != "" {
+        forgetAccount(device.Credential)
+    } else {
+        hash, err := newSecret()
+        users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+        if err != nil || users.Update(bson.M{"hash": user.Hash}, bson.M{"$set": bson.M{"hash": hash}}) != nil {
+            jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        ds.rehashUser(user.Hash, hash)
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+///////
+// Guests. A guest account is created from the device alone and has full
+// access to scores and coins. Upgrading it attaches a social identity, either
+// by renaming the guest or, when the identity already has an account, by
+// merging the guest into that account.
+
+const GUEST_PROFILE = "guest"
+
+type registerGuest struct {
+    device datatypes.Device
+}
+
+func NewRegisterGuest(device string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *registerGuest {
+    return &registerGuest{datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen, "", 0, ""}}
+}
+
+//
+// { "verb": "registerGuest", "deviceId": <device>, ... }
+// { "result": true, "answer": {"name": <guest name>, "hash": <user-id>} }
+//
+// Every registration creates a new guest: the device id is no credential, so
+// it never gives access to an existing guest. The hash is random.
+func (req *registerGuest) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    hash, err := newSecret()
+    if err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Guest registration attempt failed\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    name := "guest-" + newToken()[:12]
+    user := datatypes.User{name, "", "", req.device.DeviceId, hash, GUEST_PROFILE, name, 0, 0, 0, 0, 0, "", "", "", "", "", nil, datatypes.AccountActive, 0}
+    req.device.Owner, req.device.Linked = name, time.Seconds()
+    
+    if !ds.registerUser(&user) || !ds.registerDevice(&req.device) {
+        jsonRes := "{\"result\": false, \"answer\": \"Guest registration attempt failed\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"name": name, "hash": hash})}
+}
+
+type upgradeAccount struct {
+    hash string
+    name string
+    password string
+    displayName string
+    profile string
+    profileId string
+}
+
+func NewUpgradeAccount(hash string, name string, password string, displayName string, profile string, profileId string) *upgradeAccount {
+    return &upgradeAccount{hash, name, password, displayName, profile, profileId}
+}
+
+//
+// { "verb": "upgradeAccount", "hash": <guest user-id>, "name": <name>, "password": <password>,
+//   "profile": "fb" | "tw" | "99", "profileId": <optional id>, "displayName": <optional> }
+// { "result": true, "answer": {"name": <name>, "hash": <user-id>, "merged": <bool>} }
+//
+// When the name or the profile identity belongs to an account already, the
+// password must be that account's; the guest is merged into it and the
+// account's hash is to be used from then on.
+func (req *upgradeAccount) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    guest, found := ds.caller(req.hash)
+    if !found || guest.Profile != GUEST_PROFILE {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a guest account\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    account, exists := ds.findUser(bson.M{"$or": []bson.M{{"name": req.name},
+                                                          {"profile": req.profile, "profileid": req.profileId}}})
+    if exists {
+        if _, signedIn := ds.checkSignIn(account.Name, req.password); !signedIn {
+            jsonRes := "{\"result\": false, \"answer\": \"Wrong name or password\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        ds.mergeUser(guest, account)
+        return &datatypes.GenericResponse{jsonAnswer(bson.M{"name": account.Name, "hash": account.Hash, "merged": true})}
+    }
+    
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    key := DisplayKey(req.displayName)
+    if key != "" {
+        if n, err := users.Find(bson.M{"displaykey": key}).Count(); err != nil || n > 0 {
+            jsonRes := "{\"result\": false, \"answer\": \"Display name already taken\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+    }
+    
+    password, err := HashPassword(req.password)
+    if err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Account upgrade failed\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    change := bson.M{"name": req.name, "password": password, "profile": req.profile,
+                     "profileid": req.profileId, "displayname": req.displayName, "displaykey": key}
+    if users.Update(bson.M{"hash": req.hash, "profile": GUEST_PROFILE}, bson.M{"$set": change}) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Account upgrade failed\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    ds.renameUser(guest.Name, req.name)
+    InvalidateLeaderBoards()
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"name": req.name, "hash": req.hash, "merged": false})}
+}
+
+// The fields of the records referring to a user, by name or by hash, but
+// the members of conversations and the user's own record. Every collection
+// keeping data about users must be listed here, for users to be renamed,
+// merged, deleted and exported.
+type userField struct {
+    collection string
+    field string
+}
+
+var userNameFields = []userField{
+    {TEXT_MESSAGES, "to"}, {TEXT_MESSAGES, "from"},
+    {PENDING_COIN_REQUESTS, "requester"}, {PENDING_COIN_REQUESTS, "donor"},
+    {CONVERSATIONS, "lastfrom"}, {CONVERSATION_MESSAGES, "from"}, {CONVERSATION_READS, "member"},
+    {BLOCKED_USERS, "owner"}, {BLOCKED_USERS, "blocked"},
+    {MESSAGE_REPORTS, "reporter"}, {MESSAGE_REPORTS, "from"},
+    {FRIENDSHIPS, "from"}, {FRIENDSHIPS, "to"},
+    {REGISTERED_DEVICES, "owner"},
+}
+
+var userHashFields = []userField{
+    {GAME_SCORES, "hash"}, {QUARANTINED_SCORES, "hash"}, {GAME_RUNS, "hash"}, {USER_ACHIEVEMENTS, "hash"},
+    {PENDING_COIN_REQUESTS, "requesterhash"}, {PENDING_COIN_REQUESTS, "donorhash"},
+    {LINK_CODES, "hash"}, {PASSWORD_RESETS, "hash"},
+}
+
+// renameUser replaces a user's name in every record keyed by name. 1:1
+// conversations are re-keyed, and folded into the conversation the pair
+// already has, if any.
+func (ds *DBSession) renameUser(from string, to string) {
+    if from == to {
+        return
+    }
+    db := ds.DB(GUSTO_DB_NAME)
+    for _, ref := range userNameFields {
+        ds.updateAll(ref.collection, bson.M{ref.field: from}, bson.M{"$set": bson.M{ref.field: to}})
+    }
+    
+    // nobody blocks or befriends themselves
+    db.C(BLOCKED_USERS).RemoveAll(bson.M{"owner": to, "blocked": to})
+    db.C(FRIENDSHIPS).RemoveAll(bson.M{"from": to, "to": to})
+    
+    conversations := db.C(CONVERSATIONS)
+    var convs []datatypes.Conversation
+    if iter, err := conversations.Find(bson.M{"members": from}).Iter(); iter != nil && err == nil {
+        for {
+            var conv datatypes.Conversation
+            if iter.Next(&conv) != nil {
+                break
+            }
+            convs = append(convs, conv)
+        }
+    }
+    for _, conv := range convs {
+        for i, member := range conv.Members {
+            if member == from {
+                conv.Members[i] = to
+            }
+        }
+        if conv.Group || len(conv.Members) != 2 {
+            conversations.Update(bson.M{"convid": conv.ConvId}, bson.M{"$set": bson.M{"members": conv.Members}})
+            continue
+        }
+        
+        id := directConversationId(conv.Members[0], conv.Members[1])
+        if _, found := ds.conversation(id); found {
+            conversations.Remove(bson.M{"convid": conv.ConvId})
+            db.C(CONVERSATION_READS).RemoveAll(bson.M{"convid": conv.ConvId})
+        } else {
+            conversations.Update(bson.M{"convid": conv.ConvId}, bson.M{"$set": bson.M{"convid": id, "members": conv.Members}})
+            ds.updateAll(CONVERSATION_READS, bson.M{"convid": conv.ConvId}, bson.M{"$set": bson.M{"convid": id}})
+        }
+        ds.updateAll(CONVERSATION_MESSAGES, bson.M{"conversation": conv.ConvId}, bson.M{"$set": bson.M{"conversation": id}})
+        ds.updateAll(TEXT_MESSAGES, bson.M{"conversation": conv.ConvId}, bson.M{"$set": bson.M{"conversation": id}})
+    }
+}
+
+// updateAll applies the change to every document matching the selector
+func (ds *DBSession) updateAll(collection string, selector bson.M, change bson.M) {
+    ds.DB(GUSTO_DB_NAME).C(collection).UpdateAll(selector, change)
+}
+
+// rehashUser replaces a user's hash in every record keyed by hash, but the
+// user's own record
+func (ds *DBSession) rehashUser(from string, to string) {
+    if from == to {
+        return
+    }
+    ds.DB(GUSTO_DB_NAME).C(LINK_CODES).RemoveAll(bson.M{"hash": from})
+    for _, ref := range userHashFields {
+        ds.updateAll(ref.collection, bson.M{ref.field: from}, bson.M{"$set": bson.M{ref.field: to}})
+    }
+    forgetAccount(from)
+    forgetAccount(to)
+}
+
+// mergeUser moves everything a user owns to another user, keeping the best
+// score of every game and the furthest progress of every achievement, then
+// removes the first user.
+func (ds *DBSession) mergeUser(from *datatypes.User, into *datatypes.User) {
+    db := ds.DB(GUSTO_DB_NAME)
+    
+    scores := db.C(GAME_SCORES)
+    iterate(scores.Find(bson.M{"hash": from.Hash}), func(doc bson.M) {
+        score, _ := doc["score"].(int)
+        selector := bson.M{"hash": into.Hash, "game": doc["game"]}
+        if n, err := scores.Find(selector).Count(); err == nil && n > 0 {
+            scores.Update(bson.M{"hash": into.Hash, "game": doc["game"], "score": bson.M{"$lt": score}},
+                          bson.M{"$set": bson.M{"score": score, "updated": doc["updated"]}})
+            scores.Remove(bson.M{"hash": from.Hash, "game": doc["game"]})
+        }
+    })
+    
+    unlocks := db.C(USER_ACHIEVEMENTS)
+    iterate(unlocks.Find(bson.M{"hash": from.Hash}), func(doc bson.M) {
+        progress, _ := doc["progress"].(int)
+        unlocked, _ := doc["unlocked"].(int64)
+        selector := bson.M{"hash": into.Hash, "game": doc["game"], "id": doc["id"]}
+        if n, err := unlocks.Find(selector).Count(); err == nil && n > 0 {
+            unlocks.Update(bson.M{"hash": into.Hash, "game": doc["game"], "id": doc["id"], "progress": bson.M{"$lt": progress}},
+                           bson.M{"$set": bson.M{"progress": progress}})
+            if unlocked > 0 {
+                unlocks.Update(bson.M{"hash": into.Hash, "game": doc["game"], "id": doc["id"],
+                                      "$or": []bson.M{{"unlocked": 0}, {"unlocked": bson.M{"$gt": unlocked}}}},
+                               bson.M{"$set": bson.M{"unlocked": unlocked}})
+            }
+            unlocks.Remove(bson.M{"hash": from.Hash, "game": doc["game"], "id": doc["id"]})
+        }
+    })
+    
+    db.C(GAME_RUNS).RemoveAll(bson.M{"hash": from.Hash})
+    ds.rehashUser(from.Hash, into.Hash)
+    ds.renameUser(from.Name, into.Name)
+    
+    db.C(REGISTERED_USERS).Update(bson.M{"hash": into.Hash},
+                                  bson.M{"$inc": bson.M{"score": from.Score, "borrowed": from.Borrowed,
+                                                        "earned": from.Earned, "donated": from.Donated,
+                                                        "messagessent": from.MessagesSent}})
+    db.C(REGISTERED_USERS).Remove(bson.M{"hash": from.Hash})
+    InvalidateLeaderBoards()
+}
+
+// deleteUser removes a user and everything stored about them. 1:1
+// conversations go away with their history; groups lose a member. Reports
+// about the user's messages stay for review, detached from the account.
+func (ds *DBSession) deleteUser(user *datatypes.User) {
+    db := ds.DB(GUSTO_DB_NAME)
+    
+    var direct []string
+    iterate(db.C(CONVERSATIONS).Find(bson.M{"members": user.Name, "group": false}), func(doc bson.M) {
+        if id, ok := doc["convid"].(string); ok {
+            direct = append(direct, id)
+        }
+    })
+    if len(direct) > 0 {
+        db.C(CONVERSATIONS).RemoveAll(bson.M{"convid": bson.M{"$in": direct}})
+        db.C(CONVERSATION_MESSAGES).RemoveAll(bson.M{"conversation": bson.M{"$in": direct}})
+        db.C(CONVERSATION_READS).RemoveAll(bson.M{"convid": bson.M{"$in": direct}})
+    }
+    ds.updateAll(CONVERSATIONS, bson.M{"members": user.Name}, bson.M{"$pull": bson.M{"members": user.Name}})
+    ds.updateAll(MESSAGE_REPORTS, bson.M{"from": user.Name}, bson.M{"$set": bson.M{"from": "", "deletedfrom": user.Name}})
+    
+    for _, ref := range userNameFields {
+        if ref.collection != CONVERSATIONS {
+            db.C(ref.collection).RemoveAll(bson.M{ref.field: user.Name})
+        }
+    }
+    for _, ref := range userHashFields {
+        db.C(ref.collection).RemoveAll(bson.M{ref.field: user.Hash})
+    }
+    db.C(REGISTERED_USERS).Remove(bson.M{"hash": user.Hash})
+    
+    forgetAccount(user.Hash)
+    InvalidateLeaderBoards()
+}
+
+type exportMyData struct {
+    hash string
+}
+
+func NewExportMyData(hash string) *exportMyData {
+    return &exportMyData{hash}
+}
+
+//
+// { "verb": "exportMyData", "hash": <user-id> }
+// { "result": true, "answer": {"user": {...}, "Conversations": [...], <collection>: [zero-or-more{...}], ...} }
+//
+// Every record the caller owns, grouped by collection. The blocks and the
+// reports of other players about the caller are theirs, and left out.
+func (req *exportMyData) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.caller(req.hash)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    db := ds.DB(GUSTO_DB_NAME)
+    archive := bson.M{}
+    collect := func(collection string, selector bson.M) {
+        records, _ := archive[collection].([]bson.M)
+        iterate(db.C(collection).Find(selector), func(doc bson.M) {
+            stripUnexported(doc)
+            records = append(records, doc)
+        })
+        archive[collection] = records, records != nil
+    }
+    
+    iterate(db.C(REGISTERED_USERS).Find(bson.M{"hash": user.Hash}), func(doc bson.M) {
+        stripUnexported(doc)
+        for _, field := range unexportedUserFields {
+            doc[field] = nil, false
+        }
+        archive["user"] = doc, true
+    })
+    collect(CONVERSATIONS, bson.M{"members": user.Name})
+    for _, ref := range userNameFields {
+        if ref.collection != CONVERSATIONS && !othersRecords(ref) {
+            collect(ref.collection, bson.M{ref.field: user.Name})
+        }
+    }
+    for _, ref := range userHashFields {
+        // coin requests are listed by name already, codes are credentials
+        if ref.collection != PENDING_COIN_REQUESTS && ref.collection != LINK_CODES && ref.collection != PASSWORD_RESETS {
+            collect(ref.collection, bson.M{ref.field: user.Hash})
+        }
+    }
+    return &datatypes.GenericResponse{jsonAnswer(archive)}
+}
+
+// othersRecords tells whether the records referring to a user by the field
+// belong to other players
+func othersRecords(ref userField) bool {
+    return (ref.collection == BLOCKED_USERS && ref.field == "blocked") ||
+           (ref.collection == MESSAGE_REPORTS && ref.field == "from")
+}
+
+// the fields left out of exports: credentials, or hashes standing for them,
+// and the moderation state, which shadow banned players must not learn
+var unexportedFields = []string{"_id", "password", "hash", "requesterhash", "donorhash", "credential", "shadow"}
+var unexportedUserFields = []string{"status", "until"}
+
+func stripUnexported(doc bson.M) {
+    for _, field := range unexportedFields {
+        doc[field] = nil, false
+    }
+}
+
+///////
+// Account status. Suspended and banned accounts are refused every request;
+// shadow banned accounts keep playing, but nobody else sees their scores or
+// messages.
+
+func refusedAccount(status string, until int64) (refused bool, reason string) {
+    switch status {
+    case datatypes.AccountBanned:
+        return true, "Account banned"
+    case datatypes.AccountSuspended:
+        if time.Seconds() < until {
+            return true, fmt.Sprintf("Account suspended until %d", until)
+        }
+    }
+    return false, ""
+}
+
+// AccountName returns the name of the user a hash belongs to
+func AccountName(hash string) (name string, ok bool) {
+    name = cachedAccount(hash).name
+    return name, name != ""
+}
+
+// Admit tells whether the user owning the hash may issue requests, and why
+// not. Unknown hashes are admitted: the request itself turns them away.
+func Admit(hash string) (admitted bool, reason string) {
+    if a := cachedAccount(hash); a.name != "" {
+        refused, reason := refusedAccount(a.status, a.until)
+        return !refused, reason
+    }
+    return true, ""
+}
+
+// SetAccountStatus changes the status of a user, known by any identity
+func (ds *DBSession) SetAccountStatus(id string, status string, until int64) bool {
+    user, found := ds.lookupUser(id)
+    if !found {
+        return false
+    }
+    
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    if users.Update(bson.M{"hash": user.Hash}, bson.M{"$set": bson.M{"status": status, "until": until}}) != nil {
+        return false
+    }
+    forgetAccount(user.Hash)
+    shadow := status == datatypes.AccountShadow
+    ds.updateAll(GAME_SCORES, bson.M{"hash": user.Hash, "shadow": bson.M{"$ne": shadow}},
+                 bson.M{"$set": bson.M{"shadow": shadow}})
+    InvalidateLeaderBoards()
+    fmt.Printf("Account %s: status '%s' until %d\n", user.Name, status, until)
+    return true
+}
+
+type setAccountStatus struct {
+    player string
+    status string
+    until int64
+}
+
+func NewSetAccountStatus(player string, status string, until int64) *setAccountStatus {
+    return &setAccountStatus{player, status, until}
+}
+
+//
+// { "verb": "setAccountStatus", "adminKey": <key>, "player": <any identity>,
+//   "status": "active" | "suspended" | "banned" | "shadow", "until": <time, suspensions only> }
+// { "result": true, "answer": "" }
+//
+func (req *setAccountStatus) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    if !ds.SetAccountStatus(req.player, req.status, req.until) {
+        jsonRes := "{\"result\": false, \"answer\": \"Unknown player\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+type reviewScore struct {
+    player string
+    game string
+    accept bool
+}
+
+func NewReviewScore(player string, game string, accept bool) *reviewScore {
+    return &reviewScore{player, game, accept}
+}
+
+//
+// { "verb": "acceptScore" | "rejectScore", "adminKey": <key>, "player": <any identity>, "game": <game> }
+// { "result": true, "answer": "" }
+//
+func (req *reviewScore) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.lookupUser(req.player)
+    if !found || !ds.ReviewScore(user.Hash, req.game, req.accept) {
+        jsonRes := "{\"result\": false, \"answer\": \"No quarantined score of this player in this game\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+type setScoreRule struct {
+    rule datatypes.ScoreRule
+}
+func NewSetScoreRule(rule datatypes.ScoreRule) *setScoreRule {
+    return &setScoreRule{rule}
+}
+func (req *setScoreRule) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    rules := ds.DB(GUSTO_DB_NAME).C(SCORE_RULES)
+    if rules.Upsert(bson.M{"game": req.rule.Game}, &req.rule) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    SetScoreRule(req.rule.Game, req.rule)
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+type defineAchievement struct {
+    def datatypes.AchievementDef
+}
+
+func NewDefineAchievement(def datatypes.AchievementDef) *defineAchievement {
+    return &defineAchievement{def}
+}
+
+//
+// { "verb": "defineAchievement", "adminKey": <key>, "game": <game>, "id": <id>, "title": <title>,
+//   "description": <text>, "points": <points>, "hidden": <bool>, "target": <count>,
+//   "rule": <optional rule>, "threshold": <value> }
+// { "result": true, "answer": "" }
+//
+func (req *defineAchievement) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    if !ds.DefineAchievement(&req.def) {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+///////
+// Account recovery. A reset code is sent to the user through the notifier;
+// verifying it yields a one-time token, which sets a new password and issues
+// a new hash for the device the user recovers the account on. The old hash
+// stops working, and the other devices have to be linked again.
+
+// A Notifier delivers a text to a user, by whatever means the user can be
+// reached (names are e-mail addresses, as a rule)
+type Notifier interface {
+    Notify(user *datatypes.User, subject string, text string) os.Error
+}
+
+// LogNotifier appends the notifications to a file, or prints them when no
+// file is given. For tests and local setups.
+type LogNotifier struct {
+    Path string
+}
+
+func (n *LogNotifier) Notify(user *datatypes.User, subject string, text string) os.Error {
+    line := fmt.Sprintf("%d to %s: %s: %s\n", time.Seconds(), user.Name, subject, text)
+    if n.Path == "" {
+        fmt.Print(line)
+        return nil
+    }
+    f, err := os.OpenFile(n.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    _, err = f.WriteString(line)
+    return err
+}
+
+var notifier Notifier = &LogNotifier{}
+
+func SetNotifier(n Notifier) {
+    notifier = n
+}
+
+// A reset lasts RESET_WINDOW_SECONDS from its first code: the codes re-issued
+// meanwhile share its attempts, and a player gets RESET_REQUESTS codes per
+// window at most.
+const (
+    RESET_CODE_SECONDS = 900
+    RESET_CODE_ATTEMPTS = 5
+    RESET_WINDOW_SECONDS = 3600
+    RESET_REQUESTS = 3
+)
+
+var resetRequests = NewRateLimiter(RESET_REQUESTS, RESET_WINDOW_SECONDS)
+
+func newResetCode() (string, os.Error) {
+    b := make([]byte, 4)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    n := uint32(b[0]) << 24 | uint32(b[1]) << 16 | uint32(b[2]) << 8 | uint32(b[3])
+    return fmt.Sprintf("%06d", n % 1000000), nil
+}
+
+type requestPasswordReset struct {
+    player string
+}
+
+func NewRequestPasswordReset(player string) *requestPasswordReset {
+    return &requestPasswordReset{player}
+}
+
+//
+// { "verb": "requestPasswordReset", "player": <name or profile id> }
+// { "result": true, "answer": "" }
+//
+// Answers the same whether the player exists or not, and whether a code was
+// sent or the player asked too often.
+func (req *requestPasswordReset) Perform() datatypes.Response {
+    jsonRes := "{\"result\": true, \"answer\": \"\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.lookupUser(req.player)
+    if !found || user.Profile == GUEST_PROFILE {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    if !resetRequests.Allow(user.Name) {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    resets := ds.DB(GUSTO_DB_NAME).C(PASSWORD_RESETS)
+    now := time.Seconds()
+    resets.RemoveAll(bson.M{"started": bson.M{"$lt": now - RESET_WINDOW_SECONDS}})
+    
+    code, err := newResetCode()
+    if err != nil {
+        return &datatypes.GenericResponse{"{\"result\": false, \"answer\": \"Generic datastore error\"}"}
+    }
+    reset := datatypes.PasswordReset{user.Hash, code, "", 0, now + RESET_CODE_SECONDS, now}
+    var previous datatypes.PasswordReset
+    if resets.Find(bson.M{"hash": user.Hash}).One(&previous) == nil {
+        reset.Attempts, reset.Started = previous.Attempts, previous.Started
+    }
+    if resets.Upsert(bson.M{"hash": user.Hash}, &reset) != nil {
+        return &datatypes.GenericResponse{"{\"result\": false, \"answer\": \"Generic datastore error\"}"}
+    }
+    text := "Your Marvin password reset code is " + reset.Code + ". It expires in 15 minutes."
+    if err := notifier.Notify(user, "Password reset", text); err != nil {
+        fmt.Printf("Password reset notification to %s failed: %v\n", user.Name, err)
+    }
+    return &datatypes.GenericResponse{jsonRes}
+}
+
+type verifyResetCode struct {
+    player string
+    code string
+}
+
+func NewVerifyResetCode(player string, code string) *verifyResetCode {
+    return &verifyResetCode{player, code}
+}
+
+//
+// { "verb": "verifyResetCode", "player": <name or profile id>, "code": <code> }
+// { "result": true, "answer": <reset token> }
+//
+func (req *verifyResetCode) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid or expired code\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+    
+    user, found := ds.lookupUser(req.player)
+    if !found {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    resets := ds.DB(GUSTO_DB_NAME).C(PASSWORD_RESETS)
+    selector := bson.M{"hash": user.Hash, "token": "", "expires": bson.M{"$gte": time.Seconds()},
+                       "attempts": bson.M{"$lt": RESET_CODE_ATTEMPTS}}
+    var reset datatypes.PasswordReset
+    if resets.Find(selector).One(&reset) != nil {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    if reset.Code != req.code {
+        resets.Update(bson.M{"hash": user.Hash}, bson.M{"$inc": bson.M{"attempts": 1}})
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    token, err := newSecret()
+    if err != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    if resets.Update(selector, bson.M{"$set": bson.M{"token": token}}) != nil {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{jsonAnswer(token)}
+}
+
+type resetPassword struct {
+    token string
+    password string
+    device datatypes.Device
+}
+
+func NewResetPassword(token string, password string, device string, os string, osVer string, portraitX int, portraitY int, density string, screen string) *resetPassword {
+    return &resetPassword{token, password, datatypes.Device{device, os, osVer, portraitX, portraitY, density, screen, "", 0, ""}}
+}
+
+//
+// { "verb": "resetPassword", "token": <reset token>, "password": <new password>, "deviceId": <device>, ... }
+// { "result": true, "answer": <new user-id> }
+//
+// The account gets a new random hash, and the device resetting the password
+// is the only one left linked.
+func (req *resetPassword) Perform() datatypes.Response {
+    jsonRes := "{\"result\": false, \"answer\": \"Invalid or expired reset\"}"
+    
+    ds := NewSession()
+    defer ds.Close()
+    
+    var reset datatypes.PasswordReset
+    resets := ds.DB(GUSTO_DB_NAME).C(PASSWORD_RESETS)
+    selector := bson.M{"token": req.token, "expires": bson.M{"$gte": time.Seconds()}}
+    if resets.Find(selector).One(&reset) != nil || resets.Remove(selector) != nil {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    user, found := ds.caller(reset.Hash)
+    if !found {
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    password, err := HashPassword(req.password)
+    hash, err2 := newSecret()
+    if err != nil || err2 != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+    change := bson.M{"hash": hash, "password": password, "deviceid": req.device.DeviceId}
+    if users.Update(bson.M{"hash": user.Hash}, bson.M{"$set": change}) != nil {
+        jsonRes = "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    ds.rehashUser(user.Hash, hash)
+    
+    devices := ds.DB(GUSTO_DB_NAME).C(REGISTERED_DEVICES)
+    devices.RemoveAll(bson.M{"owner": user.Name})
+    req.device.Owner, req.device.Linked = user.Name, time.Seconds()
+    devices.Insert(&req.device)
+    
+    forgetAccount(user.Hash)
+    InvalidateLeaderBoards()
+    return &datatypes.GenericResponse{jsonAnswer(hash)}
+}
+
+///////
+// Updates. Every game publishes a release manifest per platform, telling
+// clients whether they must update the app, may update it, and whether a
+// newer resource bundle is available.
+
+// CompareVersions compares dotted versions number by number, missing
+// numbers counting as 0: it returns -1, 0 or 1 as a is older, the same as, or
+// newer than b.
+func CompareVersions(a string, b string) int {
+    as, bs := strings.Split(a, "."), strings.Split(b, ".")
+    for i := 0; i < len(as) || i < len(bs); i++ {
+        x, y := 0, 0
+        if i < len(as) {
+            x, _ = strconv.Atoi(as[i])
+        }
+        if i < len(bs) {
+            y, _ = strconv.Atoi(bs[i])
+        }
+        switch {
+        case x < y: return -1
+        case x > y: return 1
+        }
+    }
+    return 0
+}
+
+func (ds *DBSession) releaseManifest(game string, os string) (*datatypes.ReleaseManifest, bool) {
+    var manifest datatypes.ReleaseManifest
+    manifests := ds.DB(GUSTO_DB_NAME).C(RELEASE_MANIFESTS)
+    if manifests.Find(bson.M{"game": game, "os": os}).One(&manifest) == nil {
+        return &manifest, true
+    }
+    if os != "" && manifests.Find(bson.M{"game": game, "os": ""}).One(&manifest) == nil {
+        return &manifest, true
+    }
+    return nil, false
+}
+
+type checkUpdates struct {
+    game string
+    os string
+    verApp string
+    verRes string
+}
+
+func NewCheckUpdates(game string, os string, verApp string, verRes string) *checkUpdates {
+    return &checkUpdates{game, os, verApp, verRes}
+}
+
+//
+// { "verb": "checkUpdates", "game": <game>, "os": <os>, "verApp": <version>, "verRes": <version>, ... }
+// { "result": true, "answer": {"app": "required" | "available" | "current", "latestApp": <version>,
+//                              "appUrl": <url>, "resources": "available" | "current", "latestRes": <version>} }
+//
+func (req *checkUpdates) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    manifest, found := ds.releaseManifest(req.game, req.os)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"No release manifest for this game\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    app := "current"
+    switch {
+    case CompareVersions(req.verApp, manifest.MinApp) < 0:
+        app = "required"
+    case CompareVersions(req.verApp, manifest.LatestApp) < 0:
+        app = "available"
+    }
+    resources := "current"
+    if CompareVersions(req.verRes, manifest.LatestRes) < 0 {
+        resources = "available"
+    }
+    return &datatypes.GenericResponse{jsonAnswer(bson.M{"app": app, "latestApp": manifest.LatestApp,
+                                                        "appUrl": manifest.AppURL, "resources": resources,
+                                                        "latestRes": manifest.LatestRes})}
+}
+
+type setReleaseManifest struct {
+    manifest datatypes.ReleaseManifest
+}
+
+func NewSetReleaseManifest(game string, os string, minApp string, latestApp string, latestRes string, appURL string) *setReleaseManifest {
+    return &setReleaseManifest{datatypes.ReleaseManifest{game, os, minApp, latestApp, latestRes, appURL}}
+}
+
+//
+// { "verb": "setReleaseManifest", "adminKey": <key>, "game": <game>, "os": <os>, "minApp": <version>,
+//   "latestApp": <version>, "latestRes": <version>, "appUrl": <url> }
+// { "result": true, "answer": "" }
+//
+func (req *setReleaseManifest) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    manifests := ds.DB(GUSTO_DB_NAME).C(RELEASE_MANIFESTS)
+    if manifests.Upsert(bson.M{"game": req.manifest.Game, "os": req.manifest.OS}, &req.manifest) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+///////
+// Resources. Every bundle of a game is served in its newest version released,
+// up to the manifest's latest resources version, in the variant of that
+// version closest to the device: the right density above all, then the right
+// screen size, then a variant made for the device's platform.
+
+// variantDistance rates how well a variant fits the device, 0 being a
+// perfect fit. Scaling assets down beats scaling them up.
+func variantDistance(variant int, device int) int {
+    switch {
+    case variant == device:
+        return 0
+    case variant == 0 || device == 0:
+        return 1
+    case variant > device:
+        return 2 * (variant - device)
+    }
+    return 2 * (device - variant) + 1
+}
+
+func bundleFitness(bundle *datatypes.ResourceBundle, density int, screen int) int {
+    fitness := 100 * variantDistance(bundle.Density, density) + 10 * variantDistance(bundle.ScreenSize, screen)
+    if bundle.OS == "" {
+        fitness++
+    }
+    return fitness
+}
+
+// bestBundles picks the bundle served for every name, in the order the names
+// first appear
+func bestBundles(bundles []datatypes.ResourceBundle, latestRes string, density int, screen int) []datatypes.ResourceBundle {
+    best := make(map[string]int)
+    var picked []datatypes.ResourceBundle
+    for _, bundle := range bundles {
+        if CompareVersions(bundle.Version, latestRes) > 0 {
+            continue
+        }
+        i, found := best[bundle.Name]
+        if !found {
+            best[bundle.Name] = len(picked)
+            picked = append(picked, bundle)
+            continue
+        }
+        newer := CompareVersions(bundle.Version, picked[i].Version)
+        if newer > 0 || newer == 0 && bundleFitness(&bundle, density, screen) < bundleFitness(&picked[i], density, screen) {
+            picked[i] = bundle
+        }
+    }
+    return picked
+}
+
+type getResourceURIs struct {
+    game string
+    os string
+    density int
+    screen int
+}
+
+func NewGetResourceURIs(game string, os string, density int, screen int) *getResourceURIs {
+    return &getResourceURIs{game, os, density, screen}
+}
+
+//
+// { "verb": "getResourceURIs", "game": <game>, "os": <os>, "density": <density>, "screenSize": <size>, ... }
+// { "result": true, "answer": [zero-or-more{"name": <bundle>, "version": <version>, "url": <url>,
+//                                           "size": <bytes>, "checksum": <sha1>}] }
+//
+// Fails for games without a release manifest.
+func (req *getResourceURIs) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    manifest, found := ds.releaseManifest(req.game, req.os)
+    if !found {
+        jsonRes := "{\"result\": false, \"answer\": \"No release manifest for this game\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    bundles := ds.DB(GUSTO_DB_NAME).C(RESOURCE_BUNDLES)
+    query := bundles.Find(bson.M{"game": req.game, "os": bson.M{"$in": []string{req.os, ""}}})
+    iter, err := query.Iter()
+    if iter == nil || err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    var all []datatypes.ResourceBundle
+    for {
+        var bundle datatypes.ResourceBundle
+        if iter.Next(&bundle) != nil {
+            break
+        }
+        all = append(all, bundle)
+    }
+    
+    picked := bestBundles(all, manifest.LatestRes, req.density, req.screen)
+    answer := make([]bson.M, 0, len(picked))
+    for _, bundle := range picked {
+        answer = append(answer, bson.M{"name": bundle.Name, "version": bundle.Version, "url": bundle.URL,
+                                       "size": bundle.Size, "checksum": bundle.Checksum})
+    }
+    return &datatypes.GenericResponse{jsonAnswer(answer)}
+}
+
+type registerResourceBundle struct {
+    bundle datatypes.ResourceBundle
+}
+
+func NewRegisterResourceBundle(bundle datatypes.ResourceBundle) *registerResourceBundle {
+    return &registerResourceBundle{bundle}
+}
+
+//
+// { "verb": "registerResourceBundle", "adminKey": <key>, "game": <game>, "name": <bundle>, "version": <version>,
+//   "os": <optional os>, "density": <optional density>, "screenSize": <optional size>,
+//   "url": <url>, "size": <bytes>, "checksum": <sha1> }
+// { "result": true, "answer": "" }
+//
+// Registering the same variant of the same version again replaces it.
+func (req *registerResourceBundle) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    b := &req.bundle
+    variant := bson.M{"game": b.Game, "name": b.Name, "version": b.Version, "os": b.OS,
+                      "density": b.Density, "screensize": b.ScreenSize}
+    bundles := ds.DB(GUSTO_DB_NAME).C(RESOURCE_BUNDLES)
+    if bundles.Upsert(variant, b) != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
+
+///////
+// Remote configuration. Rollouts pick a stable share of the registered users:
+// a user is in when the checksum of the game, the override and the id of the
+// user's record falls below the rollout percentage, so growing a rollout only
+// adds users, and renaming or rehashing the account changes nothing. Callers
+// who did not register get the overrides rolled out to everyone only.
+
+func inVersionRange(version string, min string, max string) bool {
+    if min == "" && max == "" {
+        return true
+    }
+    if version == "" {
+        return false
+    }
+    return (min == "" || CompareVersions(version, min) >= 0) && (max == "" || CompareVersions(version, max) <= 0)
+}
+
+func rolledOut(entry *datatypes.ConfigEntry, user string) bool {
+    if entry.Rollout >= 100 {
+        return true
+    }
+    if user == "" {
+        return false
+    }
+    bucket := crc32.ChecksumIEEE([]byte(entry.Game + "/" + entry.Id + "/" + user)) % 100
+    return int(bucket) < entry.Rollout
+}
+
+// preferred tells whether an entry takes precedence over the current one of
+// the same key: the higher priority wins, then the greater id, so that an
+// override wins over the base value
+func preferred(entry *datatypes.ConfigEntry, current *datatypes.ConfigEntry) bool {
+    return entry.Priority > current.Priority || entry.Priority == current.Priority && entry.Id > current.Id
+}
+
+func configApplies(entry *datatypes.ConfigEntry, target *datatypes.ConfigTarget) bool {
+    return (entry.OS == "" || entry.OS == target.OS) &&
+           inVersionRange(target.OSVer, entry.MinOSVer, entry.MaxOSVer) &&
+           inVersionRange(target.App, entry.MinApp, entry.MaxApp) &&
+           (entry.ScreenSize == 0 || entry.ScreenSize == target.ScreenSize) &&
+           (entry.Density == 0 || entry.Density == target.Density) &&
+           (entry.Country == "" || entry.Country == target.Country) &&
+           rolledOut(entry, target.User)
+}
+
+type getConfig struct {
+    hash string
+    game string
+    target datatypes.ConfigTarget
+}
+
+func NewGetConfig(hash string, game string, target datatypes.ConfigTarget) *getConfig {
+    return &getConfig{hash, game, target}
+}
+
+//
+// { "verb": "getConfig", "hash": <optional user-id>, "deviceId": <optional device>, "game": <game>, "os": <os>,
+//   "osVersion": <version>, "verApp": <version>, "density": <density>, "screenSize": <size>, "country": <code> }
+// { "result": true, "answer": {<key>: <value>, ...} }
+//
+// The country defaults to the one in the user's profile.
+func (req *getConfig) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    if req.hash != "" {
+        user, found := ds.caller(req.hash)
+        if !found {
+            jsonRes := "{\"result\": false, \"answer\": \"Not a registered user\"}"
+            return &datatypes.GenericResponse{jsonRes}
+        }
+        if req.target.Country == "" {
+            req.target.Country = user.Country
+        }
+        var record interface{}
+        users := ds.DB(GUSTO_DB_NAME).C(REGISTERED_USERS)
+        if users.Find(bson.M{"hash": user.Hash}).Select(bson.M{"_id": 1}).One(&record) == nil {
+            if data, ok := record.(bson.M); ok {
+                if id, ok := data["_id"].(bson.ObjectId); ok {
+                    req.target.User = fmt.Sprintf("%x", string(id))
+                }
+            }
+        }
+    }
+    
+    entries := ds.DB(GUSTO_DB_NAME).C(GAME_CONFIG)
+    iter, err := entries.Find(bson.M{"game": req.game}).Iter()
+    if iter == nil || err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Generic datastore error\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    
+    chosen := make(map[string]*datatypes.ConfigEntry)
+    for {
+        var entry datatypes.ConfigEntry
+        if iter.Next(&entry) != nil {
+            break
+        }
+        if current, found := chosen[entry.Key]; found && !preferred(&entry, current) {
+            continue
+        }
+        if configApplies(&entry, &req.target) {
+            e := entry
+            chosen[entry.Key] = &e
+        }
+    }
+    
+    config := make(map[string]string, len(chosen))
+    for key, entry := range chosen {
+        config[key] = entry.Value
+    }
+    return &datatypes.GenericResponse{jsonAnswer(config)}
+}
+
+type setConfig struct {
+    entry datatypes.ConfigEntry
+    remove bool
+}
+
+func NewSetConfig(entry datatypes.ConfigEntry) *setConfig {
+    return &setConfig{entry, false}
+}
+
+func NewRemoveConfig(game string, key string, id string) *setConfig {
+    return &setConfig{datatypes.ConfigEntry{Game: game, Key: key, Id: id}, true}
+}
+
+//
+// { "verb": "setConfig", "adminKey": <key>, "game": <game>, "key": <key>, "value": <value>,
+//   "id": <override, "" for the base value>, "priority": <n>, <conditions, see getConfig>,
+//   "minOsVersion", "maxOsVersion", "minApp", "maxApp": <optional versions>, "rollout": <percent> }
+// { "verb": "removeConfig", "adminKey": <key>, "game": <game>, "key": <key>, "id": <override> }
+// { "result": true, "answer": "" }
+//
+func (req *setConfig) Perform() datatypes.Response {
+    ds := NewSession()
+    defer ds.Close()
+    
+    entries := ds.DB(GUSTO_DB_NAME).C(GAME_CONFIG)
+    selector := bson.M{"game": req.entry.Game, "key": req.entry.Key, "id": req.entry.Id}
+    var err os.Error
+    if req.remove {
+        err = entries.Remove(selector)
+    } else {
+        err = entries.Upsert(selector, &req.entry)
+    }
+    if err != nil {
+        jsonRes := "{\"result\": false, \"answer\": \"Unknown configuration entry\"}"
+        return &datatypes.GenericResponse{jsonRes}
+    }
+    return &datatypes.GenericResponse{"{\"result\": true, \"answer\": \"\"}"}
+}
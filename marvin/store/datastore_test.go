@@ -0,0 +1,676 @@
+package datastore
+
+import (
+    "fmt"
+    "marvin/store/datatypes"
+    "launchpad.net/gobson/bson"
+    "strings"
+    "testing"
+)
+
+///////
+// Leaderboard cache
+
+type fakeLeaderBoards struct {
+    games  []string
+    listed int
+    built  map[string]int
+}
+
+func (f *fakeLeaderBoards) list() ([]string, bool) {
+    f.listed++
+    return f.games, true
+}
+
+func (f *fakeLeaderBoards) build(game string) ([]bson.M, bool) {
+    f.built[game]++
+    return []bson.M{bson.M{"player": game + "-player", "score": f.built[game]}}, true
+}
+
+func TestLeaderBoardCacheInvalidation(t *testing.T) {
+    tests := []struct {
+        invalidate string // "*" for everything, "" for nothing
+        listed     int
+        built      map[string]int
+    }{
+        {"", 1, map[string]int{"a": 1, "b": 1}},
+        {"", 1, map[string]int{"a": 1, "b": 1}},
+        {"a", 1, map[string]int{"a": 2, "b": 1}},
+        {"c", 2, map[string]int{"a": 2, "b": 1, "c": 1}},
+        {"*", 3, map[string]int{"a": 3, "b": 2, "c": 2}},
+    }
+
+    lb := newLeaderBoardCache()
+    f := &fakeLeaderBoards{games: []string{"a", "b"}, built: make(map[string]int)}
+    for i, test := range tests {
+        switch test.invalidate {
+        case "":
+        case "*":
+            lb.invalidateAll()
+        default:
+            if test.invalidate == "c" {
+                f.games = append(f.games, "c")
+            }
+            lb.invalidate(test.invalidate)
+        }
+
+        games, rankings, ok := lb.get(f.list, f.build)
+        if !ok || len(games) != len(f.games) || len(rankings) != len(f.games) {
+            t.Fatalf("%d: get() = %v, %v, %v", i, games, rankings, ok)
+        }
+        if f.listed != test.listed {
+            t.Errorf("%d: games listed %d times, want %d", i, f.listed, test.listed)
+        }
+        for game, n := range test.built {
+            if f.built[game] != n {
+                t.Errorf("%d: %s built %d times, want %d", i, game, f.built[game], n)
+            }
+            if score, _ := rankings[game][0]["score"].(int); score != n {
+                t.Errorf("%d: %s ranking from build %d, want %d", i, game, score, n)
+            }
+        }
+    }
+}
+
+///////
+// Around me leaderboards
+
+func TestSplitWindow(t *testing.T) {
+    tests := []struct {
+        availableAbove, availableBelow, window int
+        above, below                           int
+    }{
+        {10, 10, 5, 2, 2},
+        {10, 10, 6, 2, 3},
+        {0, 10, 5, 0, 4},  // the best player
+        {10, 0, 5, 4, 0},  // the worst player
+        {1, 10, 5, 1, 3},
+        {10, 1, 5, 3, 1},
+        {1, 1, 5, 1, 1},
+        {10, 10, 1, 0, 0},
+    }
+    for _, test := range tests {
+        above, below := splitWindow(test.availableAbove, test.availableBelow, test.window)
+        if above != test.above || below != test.below {
+            t.Errorf("splitWindow(%d, %d, %d) = %d, %d, want %d, %d", test.availableAbove, test.availableBelow,
+                     test.window, above, below, test.above, test.below)
+        }
+    }
+}
+
+func TestWindowRanks(t *testing.T) {
+    tests := []struct {
+        scores        []int
+        mine          int
+        rank, topRank int
+        ranks         []int
+    }{
+        // no ties
+        {[]int{50, 40, 30, 20, 10}, 2, 3, 1, []int{1, 2, 3, 4, 5}},
+        // ties with the player share their rank
+        {[]int{50, 30, 30, 30, 10}, 1, 2, 1, []int{1, 2, 2, 2, 5}},
+        // ties above the player
+        {[]int{50, 40, 40, 30, 20}, 3, 4, 1, []int{1, 2, 2, 4, 5}},
+        // the best scores in the window are tied with scores beyond it
+        {[]int{50, 50, 40, 30}, 3, 7, 4, []int{4, 4, 6, 7}},
+        // the player is the best
+        {[]int{50, 50, 40}, 0, 1, 1, []int{1, 1, 3}},
+        // ranked far down the board
+        {[]int{90, 80, 80, 70, 70}, 1, 101, 100, []int{100, 101, 101, 103, 103}},
+    }
+    for i, test := range tests {
+        ranks := windowRanks(test.scores, test.mine, test.rank, test.topRank)
+        for j := range ranks {
+            if ranks[j] != test.ranks[j] {
+                t.Errorf("%d: windowRanks(%v) = %v, want %v", i, test.scores, ranks, test.ranks)
+                break
+            }
+        }
+    }
+}
+
+///////
+// Rate limits
+
+func TestRateLimiter(t *testing.T) {
+    type event struct {
+        key   string
+        at    int64
+        allow bool
+    }
+    tests := []struct {
+        max    int
+        window int64
+        events []event
+    }{
+        {2, 60, []event{{"a", 0, true}, {"a", 1, true}, {"a", 2, false}, {"b", 2, true}, {"a", 60, true},
+                        {"a", 61, true}, {"a", 62, false}}},
+        // refused events do not count
+        {1, 10, []event{{"a", 0, true}, {"a", 5, false}, {"a", 10, true}}},
+        {0, 10, []event{{"a", 0, false}}},
+    }
+    for i, test := range tests {
+        rl := NewRateLimiter(test.max, test.window)
+        for j, e := range test.events {
+            if allow := rl.AllowAt(e.key, e.at); allow != e.allow {
+                t.Errorf("%d.%d: AllowAt(%s, %d) = %v, want %v", i, j, e.key, e.at, allow, e.allow)
+            }
+        }
+    }
+}
+
+func TestRateLimiterForgetsIdleKeys(t *testing.T) {
+    rl := NewRateLimiter(1, 10)
+    rl.AllowAt("a", 0)
+    rl.AllowAt("b", 5)
+    rl.AllowAt("c", 12)
+    if _, found := rl.events["a"]; found {
+        t.Errorf("idle key kept: %v", rl.events)
+    }
+    if _, found := rl.events["b"]; !found {
+        t.Errorf("active key forgotten: %v", rl.events)
+    }
+}
+
+func TestRateLimiterCountsRecordedEventsOnly(t *testing.T) {
+    rl := NewRateLimiter(2, 10)
+    tests := []struct {
+        record  bool
+        at      int64
+        blocked bool
+    }{
+        {false, 0, false},
+        {true, 1, false},
+        {false, 2, false},
+        {true, 3, true},
+        {false, 4, true},
+        {true, 5, true},
+        {false, 12, true}, // the failures at 3 and 5 still count
+        {false, 15, false},
+    }
+    for i, test := range tests {
+        if test.record {
+            rl.RecordAt("a", test.at)
+        }
+        if blocked := rl.BlockedAt("a", test.at); blocked != test.blocked {
+            t.Errorf("%d: BlockedAt(a, %d) = %v, want %v", i, test.at, blocked, test.blocked)
+        }
+    }
+}
+
+///////
+// Passwords
+
+func TestCheckPassword(t *testing.T) {
+    hashed, err := HashPassword("secret")
+    if err != nil {
+        t.Fatalf("HashPassword: %v", err)
+    }
+    if again, _ := HashPassword("secret"); again == hashed {
+        t.Errorf("HashPassword did not salt: %s", hashed)
+    }
+    tests := []struct {
+        stored   string
+        password string
+        ok       bool
+    }{
+        {hashed, "secret", true},
+        {hashed, "Secret", false},
+        {hashed, "", false},
+        {hashed[:len(hashed) - 1], "secret", false},
+        {"sha1$nodigest", "secret", false},
+        // stored before passwords were hashed
+        {"secret", "secret", true},
+        {"secret", "other", false},
+        // accounts without a password
+        {"", "", false},
+        {"", "secret", false},
+    }
+    for i, test := range tests {
+        if ok := checkPassword(test.stored, test.password); ok != test.ok {
+            t.Errorf("%d: checkPassword(%q, %q) = %v, want %v", i, test.stored, test.password, ok, test.ok)
+        }
+    }
+    if stored, _ := HashPassword(""); stored != "" {
+        t.Errorf("HashPassword(\"\") = %q, want \"\"", stored)
+    }
+}
+
+///////
+// Achievements
+
+func TestPublicAchievements(t *testing.T) {
+    achievements := []bson.M{
+        {"game": "g", "id": "unlocked", "unlocked": int64(10), "hidden": false},
+        {"game": "g", "id": "in-progress", "unlocked": int64(0), "hidden": false},
+        {"game": "g", "id": "hidden", "unlocked": int64(10), "hidden": true},
+        // legacy unlocks carry no hidden flag
+        {"game": LEGACY_ACHIEVEMENT_GAME, "id": "7", "unlocked": int64(10)},
+    }
+    visible := publicAchievements(achievements)
+    want := []string{"unlocked", "7"}
+    if len(visible) != len(want) {
+        t.Fatalf("publicAchievements = %v, want ids %v", visible, want)
+    }
+    for i, a := range visible {
+        if a["id"] != want[i] {
+            t.Errorf("publicAchievements = %v, want ids %v", visible, want)
+            break
+        }
+    }
+}
+
+///////
+// Messages
+
+func TestConversationPaging(t *testing.T) {
+    // sent times, newest first, with several messages in the same seconds
+    times := []int64{30, 20, 20, 20, 20, 20, 10, 10, 5}
+    history := make([]bson.M, len(times))
+    for i, sent := range times {
+        history[i] = bson.M{"id": fmt.Sprintf("m%d", i), "sent": sent}
+    }
+    // what the query of a page returns
+    page := func(cursor string, limit int) []bson.M {
+        sent, seen, ok := parseCursor(cursor)
+        if cursor != "" && !ok {
+            t.Fatalf("parseCursor(%q) failed", cursor)
+        }
+        var messages []bson.M
+        for _, m := range history {
+            at := m["sent"].(int64)
+            skip := false
+            for _, id := range seen {
+                skip = skip || id == m["id"]
+            }
+            if (cursor == "" || at < sent || at == sent && !skip) && len(messages) < limit {
+                messages = append(messages, m)
+            }
+        }
+        return messages
+    }
+
+    for limit := 1; limit <= len(times); limit++ {
+        returned := make(map[string]int)
+        cursor := ""
+        for pages := 0; pages <= len(times); pages++ {
+            messages := page(cursor, limit)
+            for _, m := range messages {
+                returned[m["id"].(string)]++
+            }
+            if len(messages) < limit {
+                break
+            }
+            sent, seen, _ := parseCursor(cursor)
+            cursor = pageCursor(messages, sent, seen)
+        }
+        for _, m := range history {
+            if n := returned[m["id"].(string)]; n != 1 {
+                t.Errorf("limit %d: %s returned %d times", limit, m["id"], n)
+            }
+        }
+    }
+
+    for _, bad := range []string{"20", "x:m1", "20:m1:m2"} {
+        if _, _, ok := parseCursor(bad); ok {
+            t.Errorf("parseCursor(%q) succeeded", bad)
+        }
+    }
+}
+
+func TestReservedName(t *testing.T) {
+    tests := []struct {
+        name     string
+        reserved bool
+    }{
+        {SYSTEM_SENDER, true},
+        {strings.ToUpper(SYSTEM_SENDER), true},
+        {"  " + SYSTEM_SENDER + " ", true},
+        {SYSTEM_SENDER + "2", false},
+        {"player1", false},
+        {"", false},
+    }
+    for _, test := range tests {
+        if reserved := ReservedName(test.name); reserved != test.reserved {
+            t.Errorf("ReservedName(%q) = %v, want %v", test.name, reserved, test.reserved)
+        }
+    }
+}
+
+///////
+// Presence
+
+func TestOnlineAt(t *testing.T) {
+    tests := []struct {
+        connected bool
+        seen      int64
+        online    bool
+    }{
+        {true, 0, true},
+        {false, 0, false},       // never seen
+        {false, 1000, true},
+        {false, 880, true},      // right at the threshold
+        {false, 879, false},
+        {true, 100, true},
+    }
+    for _, test := range tests {
+        if online := onlineAt(test.connected, test.seen, 1000, 120); online != test.online {
+            t.Errorf("onlineAt(%v, %d, 1000, 120) = %v, want %v", test.connected, test.seen, online, test.online)
+        }
+    }
+}
+
+func TestResolveIds(t *testing.T) {
+    docs := []bson.M{
+        {"hash": "alice**dev1", "name": "alice1", "profileid": "100"},
+        {"hash": "bobby**dev2", "name": "bobby2", "profileid": "alice1"},
+        {"hash": "carol**dev3", "name": "carol3"},
+    }
+    tests := []struct {
+        id   string
+        name string // "" when not found
+    }{
+        {"alice**dev1", "alice1"},
+        {"100", "alice1"},
+        // names win over profile ids
+        {"alice1", "alice1"},
+        {"bobby2", "bobby2"},
+        {"carol3", "carol3"},
+        {"nobody", ""},
+    }
+
+    ids := make([]string, len(tests))
+    for i, test := range tests {
+        ids[i] = test.id
+    }
+    found := resolveIds(ids, docs)
+    for _, test := range tests {
+        doc, ok := found[test.id]
+        name, _ := doc["name"].(string)
+        if ok != (test.name != "") || name != test.name {
+            t.Errorf("resolveIds(%s) = %v, %v, want %s", test.id, doc, ok, test.name)
+        }
+    }
+}
+
+///////
+// Leaderboards
+
+func TestWithOwnScore(t *testing.T) {
+    board := func(scores ...int) []bson.M {
+        entries := make([]bson.M, len(scores))
+        for i, score := range scores {
+            entries[i] = bson.M{"player": "other", "score": score}
+        }
+        return entries
+    }
+    tests := []struct {
+        scores []bson.M
+        score  int
+        size   int
+        at     int // -1 when left out
+        length int
+    }{
+        {board(50, 40, 30), 45, 10, 1, 4},
+        {board(50, 40, 30), 60, 10, 0, 4},
+        {board(50, 40, 30), 10, 10, 3, 4},
+        // after the scores it ties with
+        {board(50, 40, 40, 30), 40, 10, 3, 5},
+        // the worst score drops off a full board
+        {board(50, 40, 30), 45, 3, 1, 3},
+        {board(50, 40, 30), 30, 3, -1, 3},
+        {board(), 10, 3, 0, 1},
+    }
+    for i, test := range tests {
+        cached := len(test.scores)
+        ranked := withOwnScore(test.scores, bson.M{"player": "me", "score": test.score}, test.size)
+        if len(ranked) != test.length {
+            t.Errorf("%d: %d entries, want %d", i, len(ranked), test.length)
+        }
+        at := -1
+        for j, entry := range ranked {
+            if entry["player"] == "me" {
+                at = j
+            }
+        }
+        if at != test.at {
+            t.Errorf("%d: ranked at %d, want %d", i, at, test.at)
+        }
+        if len(test.scores) != cached || (cached > 0 && test.scores[0]["player"] != "other") {
+            t.Errorf("%d: cached ranking modified: %v", i, test.scores)
+        }
+    }
+}
+
+func TestRefusedAccount(t *testing.T) {
+    tests := []struct {
+        status  string
+        until   int64
+        refused bool
+    }{
+        {datatypes.AccountActive, 0, false},
+        {datatypes.AccountShadow, 0, false},
+        {datatypes.AccountBanned, 0, true},
+        {datatypes.AccountSuspended, 1 << 62, true},
+        {datatypes.AccountSuspended, 1, false},
+    }
+    for _, test := range tests {
+        if refused, _ := refusedAccount(test.status, test.until); refused != test.refused {
+            t.Errorf("refusedAccount(%s, %d) = %v, want %v", test.status, test.until, refused, test.refused)
+        }
+    }
+}
+
+///////
+// Updates
+
+func TestCompareVersions(t *testing.T) {
+    tests := []struct {
+        a, b string
+        cmp  int
+    }{
+        {"1.0", "1.0", 0},
+        {"1.0", "1.0.0", 0},
+        {"1", "1.0.0", 0},
+        {"1.2", "1.10", -1},
+        {"1.10", "1.9", 1},
+        {"2.0", "1.99.99", 1},
+        {"1.0.1", "1.0", 1},
+        {"1.0", "1.0.1", -1},
+        {"", "0", 0},
+        {"", "0.1", -1},
+        // unparsable parts count as 0
+        {"1.x", "1.0", 0},
+    }
+    for _, test := range tests {
+        if cmp := CompareVersions(test.a, test.b); cmp != test.cmp {
+            t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.a, test.b, cmp, test.cmp)
+        }
+    }
+}
+
+///////
+// Resources
+
+func TestVariantDistance(t *testing.T) {
+    tests := []struct {
+        variant, device int
+        distance        int
+    }{
+        {datatypes.MDPI, datatypes.MDPI, 0},
+        {0, datatypes.MDPI, 1},   // any density
+        {datatypes.MDPI, 0, 1},   // unknown device
+        {datatypes.HDPI, datatypes.MDPI, 2},
+        {datatypes.XDPI, datatypes.MDPI, 4},
+        {datatypes.LDPI, datatypes.MDPI, 3},
+        {datatypes.LDPI, datatypes.XDPI, 7},
+    }
+    for _, test := range tests {
+        if d := variantDistance(test.variant, test.device); d != test.distance {
+            t.Errorf("variantDistance(%d, %d) = %d, want %d", test.variant, test.device, d, test.distance)
+        }
+    }
+}
+
+func TestBestBundles(t *testing.T) {
+    bundle := func(name string, version string, os string, density int, screen int) datatypes.ResourceBundle {
+        url := fmt.Sprintf("%s-%s-%s-%d", name, version, os, density)
+        return datatypes.ResourceBundle{"game", name, version, os, density, screen, url, 0, ""}
+    }
+    hdpi, any := datatypes.HDPI, 0
+    tests := []struct {
+        bundles   []datatypes.ResourceBundle
+        latestRes string
+        urls      []string
+    }{
+        // the newest version released
+        {[]datatypes.ResourceBundle{bundle("art", "1.0", "", any, 0), bundle("art", "1.1", "", any, 0)}, "2.0",
+         []string{"art-1.1--0"}},
+        // versions beyond the latest released are not served
+        {[]datatypes.ResourceBundle{bundle("art", "1.0", "", any, 0), bundle("art", "1.1", "", any, 0)}, "1.0",
+         []string{"art-1.0--0"}},
+        {[]datatypes.ResourceBundle{bundle("art", "1.1", "", any, 0)}, "1.0", nil},
+        // a newer version beats a better fitting older one
+        {[]datatypes.ResourceBundle{bundle("art", "1.0", "", hdpi, 0), bundle("art", "1.1", "", any, 0)}, "2.0",
+         []string{"art-1.1--0"}},
+        // the best fitting variant of the newest version
+        {[]datatypes.ResourceBundle{bundle("art", "1.1", "", any, 0), bundle("art", "1.1", "", hdpi, 0),
+                                     bundle("art", "1.1", "", datatypes.XDPI, 0)}, "2.0",
+         []string{"art-1.1--3"}},
+        // the platform's own variant, when it fits as well
+        {[]datatypes.ResourceBundle{bundle("art", "1.0", "", hdpi, 0), bundle("art", "1.0", "ios", hdpi, 0)}, "2.0",
+         []string{"art-1.0-ios-3"}},
+        // every name, in the order they appear
+        {[]datatypes.ResourceBundle{bundle("sfx", "1.0", "", any, 0), bundle("art", "1.0", "", any, 0),
+                                     bundle("sfx", "1.2", "", any, 0)}, "2.0",
+         []string{"sfx-1.2--0", "art-1.0--0"}},
+    }
+    for i, test := range tests {
+        picked := bestBundles(test.bundles, test.latestRes, hdpi, datatypes.Normal)
+        urls := make([]string, len(picked))
+        for j, bundle := range picked {
+            urls[j] = bundle.URL
+        }
+        if len(urls) != len(test.urls) {
+            t.Errorf("%d: bestBundles = %v, want %v", i, urls, test.urls)
+            continue
+        }
+        for j := range urls {
+            if urls[j] != test.urls[j] {
+                t.Errorf("%d: bestBundles = %v, want %v", i, urls, test.urls)
+                break
+            }
+        }
+    }
+}
+
+///////
+// Remote configuration
+
+func TestInVersionRange(t *testing.T) {
+    tests := []struct {
+        version, min, max string
+        in                bool
+    }{
+        {"", "", "", true},
+        {"1.0", "", "", true},
+        {"", "1.0", "", false},
+        {"1.0", "1.0", "", true},
+        {"0.9", "1.0", "", false},
+        {"2.0", "", "1.5", false},
+        {"1.5", "", "1.5", true},
+        {"1.2", "1.0", "1.5", true},
+        {"1.10", "1.0", "1.9", false},
+    }
+    for _, test := range tests {
+        if in := inVersionRange(test.version, test.min, test.max); in != test.in {
+            t.Errorf("inVersionRange(%q, %q, %q) = %v, want %v", test.version, test.min, test.max, in, test.in)
+        }
+    }
+}
+
+func TestRolledOut(t *testing.T) {
+    tests := []struct {
+        rollout int
+        user    string
+        in      bool
+    }{
+        {100, "", true},
+        {100, "4e8a1b2c3d4e5f6a7b8c9d0e", true},
+        {0, "4e8a1b2c3d4e5f6a7b8c9d0e", false},
+        // unregistered callers only get what is rolled out to everyone
+        {99, "", false},
+    }
+    for _, test := range tests {
+        entry := &datatypes.ConfigEntry{Game: "game", Id: "test", Rollout: test.rollout}
+        if in := rolledOut(entry, test.user); in != test.in {
+            t.Errorf("rolledOut(%d%%, %q) = %v, want %v", test.rollout, test.user, in, test.in)
+        }
+    }
+
+    // growing a rollout only adds users, and picks about the right share
+    in := make(map[string]bool)
+    for _, rollout := range []int{10, 30, 60} {
+        count := 0
+        for i := 0; i < 1000; i++ {
+            user := fmt.Sprintf("%024x", i)
+            entry := &datatypes.ConfigEntry{Game: "game", Id: "grow", Rollout: rollout}
+            if rolledOut(entry, user) {
+                count++
+                in[user] = true
+            } else if in[user] {
+                t.Errorf("%s left the rollout growing to %d%%", user, rollout)
+            }
+        }
+        if count < rollout * 10 - 60 || count > rollout * 10 + 60 {
+            t.Errorf("%d users in a %d%% rollout of 1000", count, rollout)
+        }
+    }
+}
+
+func TestConfigApplies(t *testing.T) {
+    target := &datatypes.ConfigTarget{"4e8a1b2c3d4e5f6a7b8c9d0e", "ios", "5.0", "1.2", datatypes.Normal, datatypes.XDPI, "IN"}
+    tests := []struct {
+        entry   datatypes.ConfigEntry
+        applies bool
+    }{
+        {datatypes.ConfigEntry{Rollout: 100}, true},
+        {datatypes.ConfigEntry{OS: "ios", Rollout: 100}, true},
+        {datatypes.ConfigEntry{OS: "android", Rollout: 100}, false},
+        {datatypes.ConfigEntry{MinOSVer: "4.0", MaxOSVer: "5.0", Rollout: 100}, true},
+        {datatypes.ConfigEntry{MinOSVer: "5.1", Rollout: 100}, false},
+        {datatypes.ConfigEntry{MinApp: "1.3", Rollout: 100}, false},
+        {datatypes.ConfigEntry{ScreenSize: datatypes.Normal, Density: datatypes.XDPI, Rollout: 100}, true},
+        {datatypes.ConfigEntry{ScreenSize: datatypes.Large, Rollout: 100}, false},
+        {datatypes.ConfigEntry{Density: datatypes.HDPI, Rollout: 100}, false},
+        {datatypes.ConfigEntry{Country: "IN", Rollout: 100}, true},
+        {datatypes.ConfigEntry{Country: "US", Rollout: 100}, false},
+        {datatypes.ConfigEntry{OS: "ios", Rollout: 0}, false},
+    }
+    for i, test := range tests {
+        if applies := configApplies(&test.entry, target); applies != test.applies {
+            t.Errorf("%d: configApplies(%+v) = %v, want %v", i, test.entry, applies, test.applies)
+        }
+    }
+}
+
+func TestPreferred(t *testing.T) {
+    tests := []struct {
+        entry, current datatypes.ConfigEntry
+        preferred      bool
+    }{
+        {datatypes.ConfigEntry{Id: "a", Priority: 2}, datatypes.ConfigEntry{Id: "b", Priority: 1}, true},
+        {datatypes.ConfigEntry{Id: "b", Priority: 1}, datatypes.ConfigEntry{Id: "a", Priority: 2}, false},
+        // ties go to the greater id, whatever the order the entries come in
+        {datatypes.ConfigEntry{Id: "b", Priority: 1}, datatypes.ConfigEntry{Id: "a", Priority: 1}, true},
+        {datatypes.ConfigEntry{Id: "a", Priority: 1}, datatypes.ConfigEntry{Id: "b", Priority: 1}, false},
+        // overrides win over the base value
+        {datatypes.ConfigEntry{Id: "a"}, datatypes.ConfigEntry{Id: ""}, true},
+        {datatypes.ConfigEntry{Id: ""}, datatypes.ConfigEntry{Id: "a"}, false},
+    }
+    for i, test := range tests {
+        if p := preferred(&test.entry, &test.current); p != test.preferred {
+            t.Errorf("%d: preferred(%+v, %+v) = %v, want %v", i, test.entry, test.current, p, test.preferred)
+        }
+    }
+}
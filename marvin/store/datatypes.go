@@ -8,12 +8,31 @@ type User struct {
     DeviceId    string
     Hash        string     //bson.Binary
     Profile     string     // "fb" - facebook, "tw" - twitter, "99" - us!
+    ProfileId   string     // id of the user on the profile's network
     Score       int
     Borrowed    int
     Earned      int
-    Achievements int //[]string
+    Donated     int        /* coins given away, ever */
+    MessagesSent int
+    AvatarURL   string
+    Locale      string     // "en_US"
+    Country     string     // "US"
+    Bio         string
+    DisplayKey  string     /* normalized display name, unique among users */
+    Private     []string   /* profile fields hidden from other players */
+    Status      string     /* see the account statuses below */
+    Until       int64      /* end of a suspension */
 }
 
+// Account statuses. Suspended and banned users are turned away; the scores
+// and messages of shadow banned users are only visible to themselves.
+const (
+    AccountActive    = ""
+    AccountSuspended = "suspended"
+    AccountBanned    = "banned"
+    AccountShadow    = "shadow"
+)
+
 // we may want to add location and other information
 type Device struct {
     DeviceId    string
@@ -23,6 +42,28 @@ type Device struct {
     PortraitY   int
     Density     string
     ScreenSize  string
+    Owner       string     /* name of the user the device is linked to */
+    Linked      int64
+    Credential  string     /* the device's own credential, "" when it holds the account's hash */
+}
+
+// A password reset in progress. The code is sent to the user; once verified,
+// the token authorizes setting the new password.
+type PasswordReset struct {
+    Hash        string
+    Code        string
+    Token       string     /* empty until the code is verified */
+    Attempts    int        /* failed verifications since Started, across re-issued codes */
+    Expires     int64
+    Started     int64
+}
+
+// A short lived code, shown on a device already linked to the account, that
+// links a new device
+type LinkCode struct {
+    Code        string
+    Hash        string
+    Expires     int64
 }
 
 type CoinsRequest struct {
@@ -42,6 +83,109 @@ type CoinsOffer struct {
     EarnedOnDevice     int
 }
 
+// Plausibility limits for the scores submitted to a game. Zero values
+// disable the corresponding check.
+type ScoreRule struct {
+    Game                string
+    MinScore            int
+    MaxScore            int
+    MaxPointsPerSecond  int   /* fastest believable rate of scoring */
+    MinRunSeconds       int64 /* shortest believable run */
+    RequireRun          bool  /* scores must be submitted through endRun */
+}
+
+// A score held back for review instead of replacing the player's score
+type QuarantinedScore struct {
+    Hash        string
+    Game        string
+    Score       int
+    Submitted   int64
+}
+
+// A run is opened by startRun and closed by the endRun that submits its score
+type GameRun struct {
+    Token       string
+    Hash        string
+    Game        string
+    Started     int64
+}
+
+// An achievement a game offers, as listed in the catalog
+type AchievementDef struct {
+    Game        string
+    Id          string
+    Title       string
+    Description string
+    Points      int
+    Hidden      bool    /* not listed until unlocked */
+    Target      int     /* > 1 for achievements unlocked by progress */
+    Rule        string  /* server evaluated condition, see below */
+    Threshold   int     /* the rule holds from this value onwards */
+}
+
+// Achievement rules evaluated by the server. A "score" rule applies to the
+// scores of the achievement's own game.
+const (
+    RuleScore         = "score"
+    RuleCoinsDonated  = "coinsDonated"
+    RuleMessagesSent  = "messagesSent"
+)
+
+// A user's record of an achievement
+type AchievementUnlock struct {
+    Hash        string
+    Game        string
+    Id          string
+    Progress    int     /* towards the target of the achievement */
+    Unlocked    int64   /* time of the unlock, 0 while in progress */
+}
+
+// A message waiting in the receiver's inbox until acknowledged
+type ShortTextMessage struct {
+    MsgId       string
+    From        string  /* sender's name */
+    To          string  /* receiver's name */
+    Msg         string
+    Sent        int64
+    Conversation string /* the conversation the message belongs to */
+    Type        string  /* see below, plain text when empty */
+    Payload     map[string]interface{} /* details of a system message */
+}
+
+// Types of the system messages Marvin sends on game events
+const (
+    MessageText         = "text"
+    MessageCoinRequest  = "coinRequest"
+    MessageCoinGift     = "coinGift"
+    MessageScoreBeaten  = "scoreBeaten"
+    MessageAchievement  = "achievement"
+)
+
+// A 1:1 or group conversation, with a preview of its last message
+type Conversation struct {
+    ConvId      string
+    Members     []string /* names */
+    Group       bool
+    Title       string
+    Created     int64
+    Updated     int64   /* time of the last message */
+    LastFrom    string
+    LastMsg     string
+}
+
+// A friend invitation from one user to another, a friendship once accepted
+type Friendship struct {
+    From        string  /* name of the inviting user */
+    To          string  /* name of the invited user */
+    Status      string  /* "pending" or "accepted" */
+    Since       int64
+}
+
+const (
+    FriendshipPending   = "pending"
+    FriendshipAccepted  = "accepted"
+)
+
 // Response must return a JSON encoded string
 type Response interface {
     String() string
@@ -56,3 +200,78 @@ func (r *GenericResponse) String() string {
     return r.Answer
 }
 
+// The releases of a game on a platform. Versions are dotted numbers; an
+// empty OS holds for every platform without a manifest of its own.
+type ReleaseManifest struct {
+    Game        string
+    OS          string
+    MinApp      string     /* older apps must update */
+    LatestApp   string
+    LatestRes   string     /* latest resource bundle */
+    AppURL      string     /* where to get the latest app */
+}
+
+// screen sizes
+const (
+    InvalidScreen int = iota
+    Small
+    Normal
+    Large
+    XtraLarge
+)
+
+// screen densities
+const (
+    InvalidDensity int = iota
+    LDPI
+    MDPI
+    HDPI
+    XDPI
+)
+
+// A downloadable asset bundle. A bundle comes in variants for platforms,
+// screen densities and screen sizes; zero values (and an empty OS) mean the
+// variant suits any device.
+type ResourceBundle struct {
+    Game        string
+    Name        string
+    Version     string
+    OS          string
+    Density     int
+    ScreenSize  int
+    URL         string
+    Size        int64
+    Checksum    string     /* hex encoded sha1 of the bundle */
+}
+
+// A remote configuration value of a game. Base values have no Id and no
+// conditions; overrides are named by their Id and only apply to the devices
+// meeting all their conditions (zero values and empty strings always hold).
+// The matching entry of highest Priority provides the value of a key.
+type ConfigEntry struct {
+    Game        string
+    Key         string
+    Value       string
+    Id          string
+    Priority    int
+    OS          string
+    MinOSVer    string
+    MaxOSVer    string
+    MinApp      string
+    MaxApp      string
+    ScreenSize  int
+    Density     int
+    Country     string
+    Rollout     int        /* percent of the users, 100 for everyone */
+}
+
+// The device and user a configuration is requested for
+type ConfigTarget struct {
+    User        string     /* stable id of the registered user, for rollouts */
+    OS          string
+    OSVer       string
+    App         string
+    ScreenSize  int
+    Density     int
+    Country     string
+}
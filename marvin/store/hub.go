@@ -0,0 +1,64 @@
+package hub
+
+import (
+    "sync"
+)
+
+// The hub delivers events within the Marvin process. Requests waiting for
+// something to happen to a user subscribe to the user's key, and the
+// requests making it happen publish a JSON encoded event to that key.
+// Delivery is best effort: a subscriber that does not keep up loses events.
+
+const SUBSCRIBER_BUFFER = 16
+
+type hub struct {
+    sync.Mutex
+    subscribers map[string][]chan string
+}
+
+var events = &hub{subscribers: make(map[string][]chan string)}
+
+// Subscribe returns a channel receiving the events published to key
+func Subscribe(key string) chan string {
+    ch := make(chan string, SUBSCRIBER_BUFFER)
+
+    events.Lock()
+    events.subscribers[key] = append(events.subscribers[key], ch)
+    events.Unlock()
+
+    return ch
+}
+
+// Unsubscribe stops the delivery of events to a channel returned by Subscribe
+func Unsubscribe(key string, ch chan string) {
+    events.Lock()
+    defer events.Unlock()
+
+    subscribers := events.subscribers[key]
+    for i, c := range subscribers {
+        if c == ch {
+            subscribers[i] = subscribers[len(subscribers) - 1]
+            subscribers = subscribers[:len(subscribers) - 1]
+            break
+        }
+    }
+
+    if len(subscribers) == 0 {
+        events.subscribers[key] = nil, false
+    } else {
+        events.subscribers[key] = subscribers
+    }
+}
+
+// Publish sends an event to all current subscribers of key without blocking
+func Publish(key string, event string) {
+    events.Lock()
+    defer events.Unlock()
+
+    for _, ch := range events.subscribers[key] {
+        select {
+        case ch <- event:
+        default:
+        }
+    }
+}
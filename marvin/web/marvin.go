@@ -1,8 +1,14 @@
 package main
 
 import (
+    "fmt"
+    "io/ioutil"
+    "os"
     "runtime"
+    "strconv"
+    "strings"
     "marvin/cloud/request"
+    "marvin/store/datastore"
     "marvin/web/server"
     //"log"
 )
@@ -19,7 +25,66 @@ func main() {
 	    }()
 
         cloud.InitRequestHandlers()
+        initIdentityProviders()
+        initModeration()
+        initPresence()
+        cloud.SetAdminKey(os.Getenv("MARVIN_ADMIN_KEY"))
+        // no mailer yet: reset codes go to MARVIN_NOTIFY_LOG, or to the console
+        datastore.SetNotifier(&datastore.LogNotifier{os.Getenv("MARVIN_NOTIFY_LOG")})
         server.Run()
     }
 }
 
+// MARVIN_IDENTITY_STUB=1 replaces the external networks with the stub
+// provider, for tests. MARVIN_TW_VERIFY_URL points to the service verifying
+// twitter tokens, twitter does not offer one.
+func initIdentityProviders() {
+    if os.Getenv("MARVIN_IDENTITY_STUB") == "1" {
+        cloud.RegisterIdentityProvider("fb", &cloud.StubIdentityProvider{})
+        cloud.RegisterIdentityProvider("tw", &cloud.StubIdentityProvider{})
+        return
+    }
+    
+    cloud.RegisterIdentityProvider("fb", &cloud.HTTPTokenProvider{URL: "https://graph.facebook.com/me?fields=id&access_token=%s", IdField: "id"})
+    if url := os.Getenv("MARVIN_TW_VERIFY_URL"); url != "" {
+        cloud.RegisterIdentityProvider("tw", &cloud.HTTPTokenProvider{URL: url, IdField: "id_str"})
+    }
+}
+
+// MARVIN_PROFANITY_FILE lists the words messages must not contain,
+// separated by spaces or lines. MARVIN_MESSAGE_RATE limits the messages of a sender, as
+// <messages>/<seconds>. MARVIN_FILTER_URLS=0 lets links through.
+func initModeration() {
+    cloud.FilterURLs = os.Getenv("MARVIN_FILTER_URLS") != "0"
+    if path := os.Getenv("MARVIN_PROFANITY_FILE"); path != "" {
+        if data, err := ioutil.ReadFile(path); err == nil {
+            cloud.SetProfanityList(strings.Fields(string(data)))
+        } else {
+            fmt.Printf("Cannot read the profanity list: %v\n", err)
+        }
+    }
+    if rate := os.Getenv("MARVIN_MESSAGE_RATE"); rate != "" {
+        parts := strings.Split(rate, "/")
+        if len(parts) == 2 {
+            max, err1 := strconv.Atoi(parts[0])
+            window, err2 := strconv.Atoi64(parts[1])
+            if err1 == nil && err2 == nil && max > 0 && window > 0 {
+                cloud.SetMessageRate(max, window)
+                return
+            }
+        }
+        fmt.Printf("Invalid MARVIN_MESSAGE_RATE: %s\n", rate)
+    }
+}
+
+// MARVIN_ONLINE_THRESHOLD is how many seconds after their last request users
+// still count as online.
+func initPresence() {
+    if threshold := os.Getenv("MARVIN_ONLINE_THRESHOLD"); threshold != "" {
+        if seconds, err := strconv.Atoi64(threshold); err == nil && seconds > 0 {
+            datastore.SetOnlineThreshold(seconds)
+        } else {
+            fmt.Printf("Invalid MARVIN_ONLINE_THRESHOLD: %s\n", threshold)
+        }
+    }
+}
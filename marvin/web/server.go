@@ -4,7 +4,13 @@ import (
     "http"
     "fmt"
     "os"
+    "strconv"
+    "sync"
+    "websocket"
     "marvin/cloud/request"
+    "marvin/json/jsondata"
+    "marvin/store/datastore"
+    "marvin/store/hub"
 )
 
 const marvinEndPoint = "99games.mobi:9900"
@@ -18,6 +24,16 @@ func registerRequestHandlers() {
     http.Handle("/marvin/scores/", http.HandlerFunc(genericHttpPostRequestHandler))
     http.Handle("/marvin/achievements/", http.HandlerFunc(genericHttpPostRequestHandler))
     http.Handle("/marvin/leaderboard/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/friends/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/presence/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/profile/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/devices/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/admin/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/recovery/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/updates/", http.HandlerFunc(genericHttpPostRequestHandler))
+    http.Handle("/marvin/config/", http.HandlerFunc(genericHttpPostRequestHandler))
+    
+    http.Handle("/marvin/ws/", websocket.Handler(websocketHandler))
     
     http.Handle("/", http.HandlerFunc(genericInvalidRequestHandler))
 }
@@ -61,4 +77,105 @@ func genericInvalidRequestHandler(w http.ResponseWriter, req *http.Request) {
     w.Write(m)
 }
 
+//
+// The WebSocket channel. The client opens it with
+//    { "verb": "connect", "hash": <user-id> }
+// after which the server pushes the user's events as they happen,
+//    { "event": "message" | "friendInvite" | "friendAccepted" | "presence", ... }
+// and the client can send any request it could POST. Requests run
+// concurrently, so responses come back in any order as
+//    { "event": "response", "requestId": <as in the request>, "response": <response> }
+// At most MAX_SOCKET_REQUESTS run at a time: the requests arriving meanwhile
+// are answered right away with a busy response, and the socket keeps being
+// read, for pings and close frames.
+//
+const MAX_SOCKET_REQUESTS = 4
+
+type socketSession struct {
+    sync.Mutex
+    ws   *websocket.Conn
+    name string
+}
+
+func (session *socketSession) send(msg string) os.Error {
+    session.Lock()
+    defer session.Unlock()
+    return websocket.Message.Send(session.ws, msg)
+}
+
+// push forwards events from the hub until the connection is closed
+func (session *socketSession) push(events chan string, done chan bool) {
+    for {
+        var event string
+        select {
+        case event = <-events:
+        case <-done:
+            return
+        }
+        if session.send(event) != nil {
+            return
+        }
+    }
+}
+
+func websocketHandler(ws *websocket.Conn) {
+    defer ws.Close()
 
+    var hello string
+    if websocket.Message.Receive(ws, &hello) != nil {
+        return
+    }
+    name, ok := cloud.AuthenticateSocket(jsondata.JSONString(hello))
+    if !ok {
+        websocket.Message.Send(ws, "{\"result\": false, \"answer\": \"Not a registered user\"}")
+        return
+    }
+    session := &socketSession{ws: ws, name: name}
+    if session.send("{\"result\": true, \"answer\": \"connected\"}") != nil {
+        return
+    }
+
+    events := hub.Subscribe(name)
+    defer hub.Unsubscribe(name, events)
+
+    done := make(chan bool)
+    defer close(done)
+    go session.push(events, done)
+
+    datastore.SetOnline(name, true)
+    defer datastore.SetOnline(name, false)
+
+    // a long polling receiveMessage must not hold up the other requests
+    running := make(chan bool, MAX_SOCKET_REQUESTS)
+    for {
+        var msg string
+        if websocket.Message.Receive(ws, &msg) != nil {
+            break
+        }
+        select {
+        case running <- true:
+            go func() {
+                session.execute(msg)
+                <-running
+            }()
+        default:
+            session.respond(msg, "{\"result\": false, \"answer\": \"too many requests in flight, try again later\"}")
+        }
+    }
+}
+
+func (session *socketSession) execute(msg string) {
+    response := cloud.ValidateMessage(jsondata.JSONString(msg)).Perform()
+    session.respond(msg, response.String())
+}
+
+// respond sends the response to a request, with the request's id
+func (session *socketSession) respond(msg string, response string) {
+    requestId := "null"
+    if jsonMap := jsondata.UnmarshalJSON(jsondata.JSONString(msg)); jsonMap != nil {
+        if id, ok := jsonMap.GetString("requestId"); ok {
+            requestId = strconv.Quote(id)
+        }
+    }
+    session.send("{\"event\": \"response\", \"requestId\": " + requestId + ", \"response\": " + response + "}")
+}